@@ -0,0 +1,231 @@
+package main
+
+// AOF input: RDB preamble followed by RESP commands, and multi part appendonlydir of redis 7 described by manifest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const aofManifestSuffix = ".manifest"
+
+var (
+	// ErrNoManifest is returned when appendonlydir has no manifest
+	ErrNoManifest = errors.New("aof: no manifest in directory")
+	// ErrBadManifest is returned when manifest line can't be parsed
+	ErrBadManifest = errors.New("aof: bad manifest")
+	// ErrUnknownFormat is returned for -format other than auto, rdb and resp
+	ErrUnknownFormat = errors.New("aof: unknown input format")
+	// ErrTruncated is returned when last command of command log is cut off and it can't be skipped
+	ErrTruncated = errors.New("aof: input truncated in last command")
+)
+
+// parseInput parses reader as format: rdb, resp command log or auto detected RDB/AOF, truncated AOF is accepted
+// unless verified
+func parseInput(format string, reader *bufio.Reader, output chan *RedisCommand, counter *uint64, verify bool) error {
+	switch format {
+	case "auto":
+		return ParseAOF(reader, output, counter, !verify)
+	case "rdb":
+		return ParseRDB(reader, output, counter)
+	case "resp":
+		return ParseCommands(reader, output, false, false)
+	}
+	return ErrUnknownFormat
+}
+
+// ParseAOF parses RDB, RDB preamble AOF or plain AOF read from reader, commands of AOF are routed like replication stream
+func ParseAOF(reader *bufio.Reader, output chan *RedisCommand, counter *uint64, truncated bool) error {
+	signature, err := reader.Peek(len(rdbSignature))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if bytes.Equal(signature, rdbSignature) {
+		err = ParseRDB(reader, output, counter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ParseCommands(reader, output, truncated, true)
+}
+
+// ParseCommands sends commands of RESP command log (AOF, redis-cli --pipe file) split and routed by key, with truncated
+// set last command cut off is skipped as redis does with aof-load-truncated for last AOF, otherwise it is an error,
+// applied tells commands were already applied by redis, as commands of AOF
+func ParseCommands(reader *bufio.Reader, output chan *RedisCommand, truncated bool, applied bool) error {
+	stream := NewCommandStream()
+	stream.applied = applied
+
+	for {
+		// annotations (#TS:...) aren't commands
+		prefix, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if prefix[0] == '#' {
+			_, err = readLine(reader)
+			if err != nil && truncated {
+				return nil
+			}
+			if err != nil {
+				return ErrTruncated
+			}
+			continue
+		}
+
+		args, _, err := readCommand(reader)
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && truncated {
+			fmt.Fprintf(os.Stderr, "resp: input truncated, last command skipped\n")
+			return nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		if err != nil {
+			return err
+		}
+
+		err = stream.Process(args, output)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// aofManifest returns manifest of appendonlydir or manifest path, empty string for other paths
+func aofManifest(path string) (string, error) {
+	if strings.HasSuffix(path, aofManifestSuffix) {
+		return path, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		// not a directory, other inputs report their own errors
+		return "", nil
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(path, "*"+aofManifestSuffix))
+	if err != nil {
+		return "", err
+	}
+	if len(manifests) != 1 {
+		return "", ErrNoManifest
+	}
+	return manifests[0], nil
+}
+
+// files of manifest in load order: base file followed by incremental files, history files are skipped
+func loadAOFManifest(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var base string
+	var incr []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := manifestFields(line)
+		if err != nil {
+			return nil, err
+		}
+
+		// key value pairs: file <name> seq <n> type <b|h|i>
+		var name, kind string
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				name = fields[i+1]
+			case "type":
+				kind = fields[i+1]
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%w: %q", ErrBadManifest, line)
+		}
+		name = filepath.Join(filepath.Dir(path), name)
+
+		switch kind {
+		case "b":
+			base = name
+		case "i":
+			incr = append(incr, name)
+		case "h":
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrBadManifest, line)
+		}
+	}
+
+	files := incr
+	if base != "" {
+		files = append([]string{base}, incr...)
+	}
+	return files, nil
+}
+
+// split manifest line into fields, file names with spaces are quoted
+func manifestFields(line string) ([]string, error) {
+	var fields []string
+	for line != "" {
+		if line[0] != '"' {
+			field, rest, _ := strings.Cut(line, " ")
+			fields = append(fields, field)
+			line = strings.TrimLeft(rest, " ")
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrBadManifest, line)
+		}
+		field, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrBadManifest, line)
+		}
+		fields = append(fields, field)
+		line = strings.TrimLeft(line[len(quoted):], " ")
+	}
+	return fields, nil
+}
+
+// ParseAOFDir parses files of manifest in order, every file is RDB or AOF, only last one may be truncated unless verified
+func ParseAOFDir(manifest string, output chan *RedisCommand, counter *uint64, verify bool) error {
+	files, err := loadAOFManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		err = parseAOFFile(file, output, counter, !verify && i == len(files)-1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func parseAOFFile(path string, output chan *RedisCommand, counter *uint64, truncated bool) error {
+	input, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	return ParseAOF(input.Reader, output, counter, truncated)
+}
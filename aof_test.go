@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// AOF of commands in RESP
+func aofCommands(commands ...[]string) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, args := range commands {
+		writeCommand(w, args...)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// commands sent by parse, with database of every command appended
+func collectAOF(t *testing.T, parse func(output chan *RedisCommand) error) [][]string {
+	output := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- parse(output)
+		close(output)
+	}()
+
+	var cmds [][]string
+	for cmd := range output {
+		cmds = append(cmds, append(cmd.Command, string(rune('0'+cmd.DB))))
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+func TestParseAOF(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aof := append([]byte{}, rdb...)
+	aof = append(aof, aofCommands([]string{"SELECT", "1"}, []string{"SET", "a", "b"})...)
+	aof = append(aof, "#TS:1700000000\r\n"...)
+	aof = append(aof, aofCommands([]string{"MULTI"}, []string{"DEL", "x", "y"}, []string{"EXEC"})...)
+
+	expected := collectAOF(t, func(output chan *RedisCommand) error {
+		return ParseRDB(bufio.NewReader(bytes.NewReader(rdb)), output, nil)
+	})
+	expected = append(expected, []string{"SET", "a", "b", "1"}, []string{"DEL", "x", "1"}, []string{"DEL", "y", "1"})
+
+	cmds := collectAOF(t, func(output chan *RedisCommand) error {
+		return ParseAOF(bufio.NewReader(bytes.NewReader(aof)), output, nil, true)
+	})
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("commands of AOF %q", cmds)
+	}
+
+	// AOF without preamble
+	cmds = collectAOF(t, func(output chan *RedisCommand) error {
+		return ParseAOF(bufio.NewReader(bytes.NewReader(aofCommands([]string{"SET", "a", "b"}))), output, nil, true)
+	})
+	if !reflect.DeepEqual(cmds, [][]string{{"SET", "a", "b", "0"}}) {
+		t.Errorf("commands of plain AOF %q", cmds)
+	}
+}
+
+func TestParseAOFDir(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"appendonly.aof.1.base.rdb": []byte("history isn't loaded"),
+		"appendonly.aof.2.base.rdb": rdb,
+		"appendonly.aof.2.incr.aof": aofCommands([]string{"SET", "k1", "v1"}),
+		"appendonly aof.3.incr.aof": append(aofCommands([]string{"SELECT", "2"}, []string{"SET", "k2", "v2"}), "*3\r\n$3\r\nSET"...),
+		"appendonly.aof.manifest": []byte("file appendonly.aof.1.base.rdb seq 1 type h\n" +
+			"file appendonly.aof.2.base.rdb seq 2 type b\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n" +
+			"file \"appendonly aof.3.incr.aof\" seq 3 type i\n"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := aofManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest != filepath.Join(dir, "appendonly.aof.manifest") {
+		t.Fatalf("manifest %s", manifest)
+	}
+
+	expected := collectAOF(t, func(output chan *RedisCommand) error {
+		return ParseRDB(bufio.NewReader(bytes.NewReader(rdb)), output, nil)
+	})
+	expected = append(expected, []string{"SET", "k1", "v1", "0"}, []string{"SET", "k2", "v2", "2"})
+
+	cmds := collectAOF(t, func(output chan *RedisCommand) error {
+		return ParseAOFDir(manifest, output, nil, false)
+	})
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("commands of appendonlydir %q", cmds)
+	}
+
+	// only last file may be truncated, and not when verified
+	output := make(chan *RedisCommand, 100)
+	go func() {
+		for range output {
+		}
+	}()
+	if err := ParseAOFDir(manifest, output, nil, true); !errors.Is(err, ErrTruncated) {
+		t.Errorf("verified truncated appendonlydir: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "appendonly.aof.2.incr.aof"), append(aofCommands([]string{"SET", "k1", "v1"}), "*3\r\n"...), 0644)
+	if err := ParseAOFDir(manifest, output, nil, false); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated file before last one: %v", err)
+	}
+	close(output)
+
+	if manifest, err := aofManifest("./cases/memory.rdb"); manifest != "" || err != nil {
+		t.Errorf("RDB file taken as manifest %q: %v", manifest, err)
+	}
+}
+
+func TestParseInputFormat(t *testing.T) {
+	log := aofCommands([]string{"MSET", "a", "1", "b", "2"}, []string{"GET", "a"}, []string{"GET", "b"},
+		[]string{"SELECT", "3"}, []string{"DEL", "a", "b"})
+
+	cmds := collectAOF(t, func(output chan *RedisCommand) error {
+		return parseInput("resp", bufio.NewReader(bytes.NewReader(log)), output, nil, false)
+	})
+	expected := [][]string{{"MSET", "a", "1", "0"}, {"MSET", "b", "2", "0"}, {"DEL", "a", "3"}, {"DEL", "b", "3"}}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("commands of command log %q", cmds)
+	}
+
+	// MSETNX of command log wasn't applied yet, its keys stay together, MSETNX of AOF has set all its keys
+	msetnx := aofCommands([]string{"MSETNX", "a", "1", "b", "2"})
+	cmds = collectAOF(t, func(output chan *RedisCommand) error {
+		return parseInput("resp", bufio.NewReader(bytes.NewReader(msetnx)), output, nil, false)
+	})
+	if expected := [][]string{{"MSETNX", "a", "1", "b", "2", "0"}}; !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("MSETNX of command log %q", cmds)
+	}
+	cmds = collectAOF(t, func(output chan *RedisCommand) error {
+		return parseInput("auto", bufio.NewReader(bytes.NewReader(msetnx)), output, nil, false)
+	})
+	if expected := [][]string{{"MSET", "a", "1", "0"}, {"MSET", "b", "2", "0"}}; !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("MSETNX of AOF %q", cmds)
+	}
+
+	output := make(chan *RedisCommand, 10)
+	if err := parseInput("rdb", bufio.NewReader(bytes.NewReader(log)), output, nil, false); err != ErrWrongSignature {
+		t.Errorf("command log parsed as RDB: %v", err)
+	}
+	if err := parseInput("csv", bufio.NewReader(bytes.NewReader(log)), output, nil, false); err != ErrUnknownFormat {
+		t.Errorf("unknown format: %v", err)
+	}
+	// command log isn't AOF of redis, its cut off command isn't skipped
+	truncated := append(aofCommands([]string{"SET", "a", "1"}), "*3\r\n$3\r\nSET"...)
+	if err := parseInput("resp", bufio.NewReader(bytes.NewReader(truncated)), output, nil, false); err != ErrTruncated {
+		t.Errorf("truncated command log: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+// Byte budget: parser waits while commands of too many bytes are between it and their replies
+
+import (
+	"sync"
+)
+
+// ByteBudget bounds total size of commands in flight, nil budget is unlimited
+type ByteBudget struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// budget of commands sent by parser and replication stream, set by main
+var sendBudget *ByteBudget
+
+// NewByteBudget allows limit bytes in flight, nil is returned when limit isn't positive
+func NewByteBudget(limit int64) *ByteBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	b := &ByteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// Acquire waits until n bytes fit into budget, command larger than whole budget waits until nothing else is in flight
+func (b *ByteBudget) Acquire(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// Release returns n bytes to budget
+func (b *ByteBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// Used returns bytes in flight
+func (b *ByteBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.used
+}
+
+// size of command in bytes
+func (cmd *RedisCommand) size() int64 {
+	var size int64
+	for _, arg := range cmd.Command {
+		size += int64(len(arg))
+	}
+	return size
+}
+
+// emit fills in BulkSize and sends cmd to output once it fits into budget, bytes are released when reply is recorded
+func emit(output chan *RedisCommand, cmd *RedisCommand) {
+	cmd.BulkSize = cmd.size()
+	sendBudget.Acquire(cmd.BulkSize)
+	output <- cmd
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	budget := NewByteBudget(100)
+	budget.Acquire(60)
+	budget.Acquire(40)
+
+	acquired := make(chan int64)
+	go func() {
+		budget.Acquire(30)
+		acquired <- budget.Used()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("budget exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(60)
+	if used := <-acquired; used != 70 {
+		t.Errorf("%d bytes used, expected 70", used)
+	}
+
+	// command larger than budget passes alone
+	budget.Release(70)
+	budget.Acquire(500)
+	if used := budget.Used(); used != 500 {
+		t.Errorf("%d bytes used, expected 500", used)
+	}
+
+	if NewByteBudget(0) != nil {
+		t.Error("budget of 0 bytes isn't unlimited")
+	}
+}
+
+func TestParserBudget(t *testing.T) {
+	sendBudget = NewByteBudget(1)
+	defer func() { sendBudget = nil }()
+
+	file, err := os.Open("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	output := make(chan *RedisCommand, 100)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseRDB(bufio.NewReader(file), output, nil)
+	}()
+
+	// parser waits for reply of first command
+	cmd := <-output
+	if cmd.BulkSize != cmd.size() || cmd.BulkSize == 0 {
+		t.Fatalf("BulkSize %d of %d bytes", cmd.BulkSize, cmd.size())
+	}
+	select {
+	case <-output:
+		t.Fatal("parser didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats := NewSendStats()
+	stats.record(cmd, nil)
+	for {
+		select {
+		case cmd := <-output:
+			stats.record(cmd, nil)
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+// Redis Cluster target: routes every key to master owning its hash slot and follows MOVED/ASK redirects
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clusterSlots = 16384
+
+	// max redirects followed by single command
+	clusterMaxRedirects = 16
+)
+
+var (
+	// ErrNoSlotOwner is returned when cluster topology doesn't cover slot
+	ErrNoSlotOwner = errors.New("cluster: slot is not served by any node")
+	// ErrTooManyRedirects is returned when command keeps being redirected
+	ErrTooManyRedirects = errors.New("cluster: too many redirects")
+)
+
+var crc16Table = makeCRC16Table()
+
+// CRC16 XMODEM, as used by redis cluster
+func makeCRC16Table() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}
+
+// CRC16 calculate crc16 exactly as Redis Cluster
+func CRC16(p []byte) uint16 {
+	crc := uint16(0)
+	for _, v := range p {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^v]
+	}
+	return crc
+}
+
+// KeyHashSlot returns cluster slot of key, only {hashtag} is hashed when present
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16([]byte(key)) % clusterSlots)
+}
+
+// ClusterTarget sends commands to masters of redis cluster, pipelining per node
+type ClusterTarget struct {
+	password string
+	pipeline int
+	stats    *SendStats
+
+	slots [clusterSlots]string
+	nodes map[string]*pipelineNode
+}
+
+// NewClusterTarget discovers cluster topology through seed node
+func NewClusterTarget(seed string, password string, pipeline int) (*ClusterTarget, error) {
+	if pipeline < 1 {
+		pipeline = 1
+	}
+
+	target := &ClusterTarget{
+		password: password,
+		pipeline: pipeline,
+		stats:    NewSendStats(),
+		nodes:    map[string]*pipelineNode{},
+	}
+
+	err := target.refresh(seed)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// load slot owners from addr, CLUSTER SHARDS is preferred, CLUSTER SLOTS is used by redis < 7
+// and when reply of CLUSTER SHARDS can't be parsed
+func (t *ClusterTarget) refresh(addr string) error {
+	conn, err := getConn(addr, t.password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	shards, err := redis.Values(conn.Do("CLUSTER", "SHARDS"))
+	if err == nil {
+		err = t.loadShards(shards, host)
+		if err == nil {
+			return nil
+		}
+		// slots assigned before parse error may be wrong
+		t.slots = [clusterSlots]string{}
+	}
+
+	slots, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return err
+	}
+	return t.loadSlots(slots, host)
+}
+
+// CLUSTER SLOTS: start, end, master [ip, port, id, ...], replicas...
+func (t *ClusterTarget) loadSlots(slots []interface{}, host string) error {
+	for _, item := range slots {
+		slot, err := redis.Values(item, nil)
+		if err != nil {
+			return err
+		}
+		if len(slot) < 3 {
+			return fmt.Errorf("cluster: unexpected CLUSTER SLOTS entry %v", slot)
+		}
+
+		start, err := redis.Int(slot[0], nil)
+		if err != nil {
+			return err
+		}
+		end, err := redis.Int(slot[1], nil)
+		if err != nil {
+			return err
+		}
+		master, err := redis.Values(slot[2], nil)
+		if err != nil {
+			return err
+		}
+		if len(master) < 2 {
+			return fmt.Errorf("cluster: unexpected CLUSTER SLOTS node %v", master)
+		}
+
+		ip, err := redis.String(master[0], nil)
+		if err != nil {
+			return err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return err
+		}
+
+		t.assign(start, end, nodeAddr(ip, port, host))
+	}
+	return nil
+}
+
+// CLUSTER SHARDS: "slots" [start, end, ...], "nodes" [node attributes, ...]
+func (t *ClusterTarget) loadShards(shards []interface{}, host string) error {
+	for _, item := range shards {
+		shard, err := redis.Values(item, nil)
+		if err != nil {
+			return err
+		}
+
+		var slots []int
+		var master string
+		for i := 0; i+1 < len(shard); i += 2 {
+			name, err := redis.String(shard[i], nil)
+			if err != nil {
+				return err
+			}
+
+			switch name {
+			case "slots":
+				slots, err = redis.Ints(shard[i+1], nil)
+				if err != nil {
+					return err
+				}
+			case "nodes":
+				nodes, err := redis.Values(shard[i+1], nil)
+				if err != nil {
+					return err
+				}
+				for _, node := range nodes {
+					attrs, err := nodeAttrs(node)
+					if err != nil {
+						return err
+					}
+					if attrs["role"] != "master" {
+						continue
+					}
+
+					ip := attrs["endpoint"]
+					if ip == "" || ip == "?" {
+						ip = attrs["ip"]
+					}
+					port, err := strconv.Atoi(attrs["port"])
+					if err != nil {
+						return err
+					}
+					master = nodeAddr(ip, port, host)
+				}
+			}
+		}
+
+		if master == "" {
+			continue
+		}
+		for i := 0; i+1 < len(slots); i += 2 {
+			t.assign(slots[i], slots[i+1], master)
+		}
+	}
+	return nil
+}
+
+// node attributes of CLUSTER SHARDS as strings, port, tls-port and replication-offset are integers
+func nodeAttrs(node interface{}) (map[string]string, error) {
+	values, err := redis.Values(node, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("cluster: unexpected CLUSTER SHARDS node %v", values)
+	}
+
+	attrs := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		name, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch value := values[i+1].(type) {
+		case []byte:
+			attrs[name] = string(value)
+		case int64:
+			attrs[name] = strconv.FormatInt(value, 10)
+		case nil:
+			attrs[name] = ""
+		default:
+			return nil, fmt.Errorf("cluster: unexpected value of %s in CLUSTER SHARDS node: %v", name, value)
+		}
+	}
+	return attrs, nil
+}
+
+// address of node, empty ip means the node we asked
+func nodeAddr(ip string, port int, host string) string {
+	if ip == "" {
+		ip = host
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+func (t *ClusterTarget) assign(start int, end int, addr string) {
+	for slot := start; slot <= end && slot < clusterSlots; slot++ {
+		t.slots[slot] = addr
+	}
+}
+
+// connection to node, dialed on first use
+func (t *ClusterTarget) node(addr string) (*pipelineNode, error) {
+	node, ok := t.nodes[addr]
+	if ok {
+		return node, nil
+	}
+
+	conn, err := getConn(addr, t.password)
+	if err != nil {
+		return nil, err
+	}
+
+	node = &pipelineNode{addr: addr, conn: conn}
+	t.nodes[addr] = node
+	return node, nil
+}
+
+// Send routes command to owner of its key slot, keys of multi-key command must share slot
+func (t *ClusterTarget) Send(cmd *RedisCommand) error {
+	addr := t.slots[KeyHashSlot(cmd.Key)]
+	if addr == "" {
+		return ErrNoSlotOwner
+	}
+	if !cmd.sameOwner(func(key string) string { return strconv.Itoa(KeyHashSlot(key)) }) {
+		t.stats.record(cmd, ErrCrossShard)
+		return nil
+	}
+
+	node, err := t.node(addr)
+	if err != nil {
+		return err
+	}
+
+	node.pending = append(node.pending, &queuedCommand{cmd: cmd})
+	if len(node.pending) >= t.pipeline {
+		return node.flush(t.stats, t.redirect)
+	}
+	return nil
+}
+
+// SendAll queues command on every master
+func (t *ClusterTarget) SendAll(cmd *RedisCommand) error {
+	seen := map[string]bool{}
+	for _, addr := range t.slots {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		node, err := t.node(addr)
+		if err != nil {
+			return err
+		}
+		node.pending = append(node.pending, &queuedCommand{cmd: cmd})
+		if len(node.pending) >= t.pipeline {
+			err = node.flush(t.stats, t.redirect)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// follow MOVED or ASK error, other errors are counted and command is dropped
+func (t *ClusterTarget) redirect(c *queuedCommand, replyErr redis.Error) error {
+	fields := strings.Fields(string(replyErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		t.stats.record(c.cmd, replyErr)
+		return nil
+	}
+
+	c.redirects++
+	if c.redirects > clusterMaxRedirects {
+		return ErrTooManyRedirects
+	}
+
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return fmt.Errorf("cluster: bad redirect %q", replyErr)
+	}
+	addr := fields[2]
+
+	if fields[0] == "MOVED" {
+		// slot has new owner, following commands go there directly
+		t.slots[slot] = addr
+		c.asking = false
+	} else {
+		// slot is being migrated, only this command goes to importing node
+		c.asking = true
+	}
+
+	// queued without flushing, we are still reading replies of another node
+	node, err := t.node(addr)
+	if err != nil {
+		return err
+	}
+	node.pending = append(node.pending, c)
+	return nil
+}
+
+// Flush writes all pending commands, including redirected ones
+func (t *ClusterTarget) Flush() error {
+	return flushNodes(t.nodes, t.stats, t.redirect)
+}
+
+// Close writes all pending commands, including redirected ones, and closes connections
+func (t *ClusterTarget) Close() error {
+	return closeNodes(t.nodes, t.stats, t.redirect)
+}
+
+// Stats counts replies of all nodes
+func (t *ClusterTarget) Stats() *SendStats {
+	return t.stats
+}
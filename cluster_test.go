@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0x31C3 {
+		t.Fatalf("CRC16 is %#x, expected 0x31c3", crc)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	cases := map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": KeyHashSlot("user1000"),
+		"{user1000}.followers": KeyHashSlot("user1000"),
+		"foo{}{bar}":           int(CRC16([]byte("foo{}{bar}")) % clusterSlots),
+		"foo{{bar}}zap":        KeyHashSlot("{bar"),
+		"foo{bar}{zap}":        KeyHashSlot("bar"),
+	}
+
+	for key, slot := range cases {
+		if got := KeyHashSlot(key); got != slot {
+			t.Errorf("slot of %q is %d, expected %d", key, got, slot)
+		}
+	}
+}
+
+// fake cluster node answering every command with raw RESP reply of reply
+func fakeNode(t *testing.T, reply func(args []string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+				for {
+					args, _, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					writer.WriteString(reply(args))
+					if reader.Buffered() == 0 {
+						writer.Flush()
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// CLUSTER SHARDS reply as redis 7 sends it, ports and offset are integers
+func shardsReply(masters ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(masters))
+	for i, addr := range masters {
+		host, port, _ := net.SplitHostPort(addr)
+		start, end := i*clusterSlots/len(masters), (i+1)*clusterSlots/len(masters)-1
+		reply += fmt.Sprintf("*4\r\n$5\r\nslots\r\n*2\r\n:%d\r\n:%d\r\n$5\r\nnodes\r\n*1\r\n", start, end)
+		reply += "*14\r\n$2\r\nid\r\n$2\r\nid\r\n$4\r\nport\r\n:" + port + "\r\n$8\r\ntls-port\r\n:0\r\n"
+		reply += fmt.Sprintf("$2\r\nip\r\n$%d\r\n%s\r\n$8\r\nendpoint\r\n$%d\r\n%s\r\n", len(host), host, len(host), host)
+		reply += "$4\r\nrole\r\n$6\r\nmaster\r\n$18\r\nreplication-offset\r\n:72156\r\n"
+	}
+	return reply
+}
+
+// CLUSTER SLOTS reply of masters splitting slots evenly
+func slotsReply(masters ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(masters))
+	for i, addr := range masters {
+		host, port, _ := net.SplitHostPort(addr)
+		start, end := i*clusterSlots/len(masters), (i+1)*clusterSlots/len(masters)-1
+		reply += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$%d\r\n%s\r\n:%s\r\n$2\r\nid\r\n", start, end, len(host), host, port)
+	}
+	return reply
+}
+
+func TestClusterShards(t *testing.T) {
+	other := "127.0.0.1:7001"
+	var seed string
+	seed = fakeNode(t, func(args []string) string {
+		return shardsReply(seed, other)
+	})
+
+	target, err := NewClusterTarget(seed, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.slots[0] != seed || target.slots[clusterSlots/2-1] != seed || target.slots[clusterSlots/2] != other || target.slots[clusterSlots-1] != other {
+		t.Errorf("slots %s %s %s", target.slots[0], target.slots[clusterSlots/2], target.slots[clusterSlots-1])
+	}
+}
+
+func TestClusterSlotsFallback(t *testing.T) {
+	other := "127.0.0.1:7001"
+	for name, shards := range map[string]string{
+		"unknown command": "-ERR unknown subcommand 'SHARDS'\r\n",
+		"malformed":       "*1\r\n*2\r\n$5\r\nnodes\r\n*1\r\n*1\r\n$4\r\nport\r\n",
+	} {
+		var seed string
+		seed = fakeNode(t, func(args []string) string {
+			if args[1] == "SHARDS" {
+				return shards
+			}
+			return slotsReply(other, seed)
+		})
+
+		target, err := NewClusterTarget(seed, "", 1)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if target.slots[0] != other || target.slots[clusterSlots-1] != seed {
+			t.Errorf("%s: slots %s %s", name, target.slots[0], target.slots[clusterSlots-1])
+		}
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	slot := KeyHashSlot("key")
+
+	var lock sync.Mutex
+	var importing []string
+	newOwner := fakeNode(t, func(args []string) string {
+		return "+OK\r\n"
+	})
+	migrating := fakeNode(t, func(args []string) string {
+		lock.Lock()
+		importing = append(importing, args[0])
+		lock.Unlock()
+		return "+OK\r\n"
+	})
+	seed := fakeNode(t, func(args []string) string {
+		if args[0] == "CLUSTER" {
+			return "-ERR unknown subcommand\r\n"
+		}
+		if args[1] == "key" {
+			return fmt.Sprintf("-MOVED %d %s\r\n", slot, newOwner)
+		}
+		return fmt.Sprintf("-ASK %d %s\r\n", KeyHashSlot(args[1]), migrating)
+	})
+	// every slot belongs to seed
+	target := &ClusterTarget{pipeline: 1, stats: NewSendStats(), nodes: map[string]*pipelineNode{}}
+	target.assign(0, clusterSlots-1, seed)
+
+	for _, key := range []string{"key", "other"} {
+		if err := target.Send(&RedisCommand{Command: []string{"SET", key, "v"}, Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// MOVED changes owner of slot, ASK sends only the command with ASKING
+	if target.slots[slot] != newOwner || target.slots[KeyHashSlot("other")] != seed {
+		t.Errorf("owners %s %s", target.slots[slot], target.slots[KeyHashSlot("other")])
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(importing, []string{"ASKING", "SET"}) {
+		t.Errorf("importing node got %q", importing)
+	}
+	if target.stats.OK() != 2 || target.stats.Failed() != 0 {
+		t.Errorf("%d ok, %d failed", target.stats.OK(), target.stats.Failed())
+	}
+}
+
+func TestClusterRedirectLoop(t *testing.T) {
+	var seed string
+	seed = fakeNode(t, func(args []string) string {
+		return fmt.Sprintf("-MOVED %d %s\r\n", KeyHashSlot(args[1]), seed)
+	})
+	target := &ClusterTarget{pipeline: 1, stats: NewSendStats(), nodes: map[string]*pipelineNode{}}
+	target.assign(0, clusterSlots-1, seed)
+
+	err := target.Send(&RedisCommand{Command: []string{"SET", "key", "v"}, Key: "key"})
+	if err == nil {
+		err = target.Flush()
+	}
+	if err != ErrTooManyRedirects {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestClusterCrossSlot(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	node := fakeNode(t, func(args []string) string {
+		lock.Lock()
+		received = append(received, args[1])
+		lock.Unlock()
+		return "+OK\r\n"
+	})
+	target := &ClusterTarget{pipeline: 1, stats: NewSendStats(), nodes: map[string]*pipelineNode{}}
+	target.assign(0, clusterSlots-1, node)
+
+	for _, keys := range [][]string{{"{a}1", "{a}2"}, {"a", "b"}} {
+		cmd := &RedisCommand{Command: append([]string{"RENAME"}, keys...), Key: keys[0], Keys: keys}
+		if err := target.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys in different slots aren't sent even when the same node owns them
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(received, []string{"{a}1"}) {
+		t.Errorf("received %q", received)
+	}
+	if target.stats.OK() != 1 || target.stats.Failed() != 1 {
+		t.Errorf("%d ok, %d failed", target.stats.OK(), target.stats.Failed())
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+// Write commands of replication stream: key positions, SELECT and MULTI/EXEC tracking, relative expires made absolute
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// position of keys in command arguments, as key specs of redis command table
+type keySpec struct {
+	// index of first key, last key (negative counts from the end) and distance between keys
+	first int
+	last  int
+	step  int
+	// index of argument holding number of keys, keys follow it, first and last give keys before it
+	numkeys int
+	// index of first option, options may hold STORE or STOREDIST destination, as of SORT and GEORADIUS
+	options int
+	// keys are independent, command is split into one command per key
+	split bool
+}
+
+var (
+	singleKey = keySpec{first: 1, last: 1, step: 1}
+	twoKeys   = keySpec{first: 1, last: 2, step: 1}
+	allKeys   = keySpec{first: 1, last: -1, step: 1}
+)
+
+// write commands propagated by master
+var keySpecs = map[string]keySpec{
+	"SET": singleKey, "SETNX": singleKey, "SETEX": singleKey, "PSETEX": singleKey, "APPEND": singleKey,
+	"INCR": singleKey, "DECR": singleKey, "INCRBY": singleKey, "DECRBY": singleKey, "INCRBYFLOAT": singleKey,
+	"GETSET": singleKey, "GETDEL": singleKey, "GETEX": singleKey, "SETRANGE": singleKey,
+	"SETBIT": singleKey, "BITFIELD": singleKey,
+
+	"LPUSH": singleKey, "RPUSH": singleKey, "LPUSHX": singleKey, "RPUSHX": singleKey, "LINSERT": singleKey,
+	"LSET": singleKey, "LREM": singleKey, "LTRIM": singleKey, "LPOP": singleKey, "RPOP": singleKey,
+	"BLMOVE": twoKeys, "BRPOPLPUSH": twoKeys,
+
+	"SADD": singleKey, "SREM": singleKey, "SPOP": singleKey,
+
+	"HSET": singleKey, "HSETNX": singleKey, "HMSET": singleKey, "HDEL": singleKey, "HINCRBY": singleKey,
+	"HINCRBYFLOAT": singleKey, "HEXPIRE": singleKey, "HPEXPIRE": singleKey, "HEXPIREAT": singleKey,
+	"HPEXPIREAT": singleKey, "HPERSIST": singleKey,
+
+	"ZADD": singleKey, "ZINCRBY": singleKey, "ZREM": singleKey, "ZREMRANGEBYSCORE": singleKey,
+	"ZREMRANGEBYRANK": singleKey, "ZREMRANGEBYLEX": singleKey, "ZPOPMIN": singleKey, "ZPOPMAX": singleKey,
+
+	"XADD": singleKey, "XDEL": singleKey, "XTRIM": singleKey, "XSETID": singleKey, "XACK": singleKey,
+	"XCLAIM": singleKey, "XAUTOCLAIM": singleKey, "XGROUP": {first: 2, last: 2, step: 1},
+
+	"PFADD": singleKey, "GEOADD": singleKey, "SORT": {first: 1, last: 1, step: 1, options: 2},
+	"GEORADIUS":         {first: 1, last: 1, step: 1, options: 6},
+	"GEORADIUSBYMEMBER": {first: 1, last: 1, step: 1, options: 5},
+
+	"EXPIRE": singleKey, "PEXPIRE": singleKey, "EXPIREAT": singleKey, "PEXPIREAT": singleKey,
+	"PERSIST": singleKey, "RESTORE": singleKey,
+
+	"RENAME": twoKeys, "RENAMENX": twoKeys, "SMOVE": twoKeys, "RPOPLPUSH": twoKeys, "LMOVE": twoKeys,
+	"COPY": twoKeys, "ZRANGESTORE": twoKeys, "GEOSEARCHSTORE": twoKeys,
+
+	"SINTERSTORE": allKeys, "SUNIONSTORE": allKeys, "SDIFFSTORE": allKeys, "PFMERGE": allKeys,
+	"BITOP": {first: 2, last: -1, step: 1},
+
+	// destination and source keys following numkeys
+	"ZUNIONSTORE": {first: 1, last: 1, numkeys: 2}, "ZINTERSTORE": {first: 1, last: 1, numkeys: 2},
+	"ZDIFFSTORE": {first: 1, last: 1, numkeys: 2},
+
+	"EVAL": {numkeys: 2}, "EVALSHA": {numkeys: 2}, "FCALL": {numkeys: 2},
+
+	// blocking and multi-key pops of captured command logs, master propagates them as plain pops
+	"BLPOP": {first: 1, last: -2, step: 1}, "BRPOP": {first: 1, last: -2, step: 1},
+	"BZPOPMIN": {first: 1, last: -2, step: 1}, "BZPOPMAX": {first: 1, last: -2, step: 1},
+	"LMPOP": {numkeys: 1}, "ZMPOP": {numkeys: 1}, "BLMPOP": {numkeys: 2}, "BZMPOP": {numkeys: 2},
+
+	"DEL": {first: 1, last: -1, step: 1, split: true}, "UNLINK": {first: 1, last: -1, step: 1, split: true},
+	"MSET": {first: 1, last: -1, step: 2, split: true}, "MSETNX": {first: 1, last: -1, step: 2, split: true},
+}
+
+// write commands without key, they change every node of target
+var keylessWrites = map[string]bool{
+	"FLUSHALL": true, "FLUSHDB": true, "SWAPDB": true, "FUNCTION": true, "SCRIPT": true,
+}
+
+// keys returns indexes of key arguments
+func (spec keySpec) keys(args []string) []int {
+	first, last, step := spec.first, spec.last, spec.step
+
+	var keys []int
+	if spec.numkeys > 0 {
+		if spec.numkeys >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(args[spec.numkeys])
+		if err != nil || n <= 0 {
+			return nil
+		}
+		for i := first; i > 0 && i <= last && i < spec.numkeys; i++ {
+			keys = append(keys, i)
+		}
+		first, last, step = spec.numkeys+1, spec.numkeys+n, 1
+	}
+
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+
+	for i := first; i > 0 && i <= last; i += step {
+		keys = append(keys, i)
+	}
+	if spec.options > 0 && len(keys) > 0 {
+		if i := storeKey(args, spec.options); i > 0 {
+			keys = append(keys, i)
+		}
+	}
+	return keys
+}
+
+// storeKey returns index of STORE or STOREDIST destination among options starting at start, 0 when there is none
+func storeKey(args []string, start int) int {
+	for i := start; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BY", "GET", "COUNT":
+			i++
+		case "LIMIT":
+			i += 2
+		case "STORE", "STOREDIST":
+			if i+1 < len(args) {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// CommandStream turns propagated write commands into commands routed by key
+type CommandStream struct {
+	db int
+
+	// commands of transaction are sent on EXEC
+	multi bool
+	queue []*RedisCommand
+
+	now func() time.Time
+	// replication offset after current command, set by replication source, and of last command passed to output
+	offset int64
+	sent   int64
+
+	// names of commands skipped for having no key, reported once
+	skipped map[string]bool
+
+	// commands were applied on master (replication stream, AOF), not yet applied ones of command log keep MSETNX whole
+	applied bool
+}
+
+// NewCommandStream starts stream in database 0
+func NewCommandStream() *CommandStream {
+	return &CommandStream{now: time.Now, skipped: map[string]bool{}}
+}
+
+// Process translates single command, results are sent to output
+func (s *CommandStream) Process(args []string, output chan *RedisCommand) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		if len(args) != 2 {
+			return fmt.Errorf("stream: bad SELECT %q", args)
+		}
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("stream: bad SELECT %q", args)
+		}
+		s.db = db
+		return nil
+	case "MULTI":
+		s.multi = true
+		return nil
+	case "EXEC":
+		for _, cmd := range s.queue {
+			s.send(output, cmd)
+		}
+		s.multi = false
+		s.queue = nil
+		return nil
+	case "DISCARD":
+		s.multi = false
+		s.queue = nil
+		return nil
+	case "PING", "REPLCONF":
+		return nil
+	}
+
+	for _, cmd := range s.commands(args) {
+		if s.multi {
+			s.queue = append(s.queue, cmd)
+		} else {
+			s.send(output, cmd)
+		}
+	}
+	return nil
+}
+
+// command for every node isn't counted in budget, each node would release it
+func (s *CommandStream) send(output chan *RedisCommand, cmd *RedisCommand) {
+	cmd.Offset = s.offset
+	s.sent = s.offset
+	if cmd.AllNodes {
+		output <- cmd
+		return
+	}
+	emit(output, cmd)
+}
+
+// split command by key and make expire absolute, keyless writes go to every node, other commands without key are skipped
+func (s *CommandStream) commands(args []string) []*RedisCommand {
+	name := strings.ToUpper(args[0])
+
+	spec, ok := keySpecs[name]
+	var keys []int
+	if ok {
+		keys = spec.keys(args)
+	}
+	if len(keys) == 0 && keylessWrites[name] {
+		return []*RedisCommand{{Command: args, DB: s.db, AllNodes: true}}
+	}
+	if len(keys) == 0 {
+		if !s.skipped[name] {
+			fmt.Fprintf(os.Stderr, "stream: %s has no key, skipped\n", args[0])
+			s.skipped[name] = true
+		}
+		return nil
+	}
+
+	// MSETNX of command log sets all its keys or none, so they stay together and must have the same owner
+	split := spec.split && (name != "MSETNX" || s.applied)
+	if !split {
+		cmd := &RedisCommand{Command: args, Key: args[keys[0]], DB: s.db}
+		if len(keys) > 1 {
+			for _, i := range keys {
+				cmd.Keys = append(cmd.Keys, args[i])
+			}
+		}
+		return s.expireCommands(cmd)
+	}
+
+	// MSETNX was applied, so it has set all keys
+	if name == "MSETNX" {
+		name = "MSET"
+	}
+
+	cmds := make([]*RedisCommand, 0, len(keys))
+	for _, i := range keys {
+		end := i + spec.step
+		if end > len(args) {
+			end = len(args)
+		}
+		command := append([]string{name}, args[i:end]...)
+		cmds = append(cmds, &RedisCommand{Command: command, Key: args[i], DB: s.db})
+	}
+	return cmds
+}
+
+// relative expires are converted to PEXPIREAT, otherwise they would be delayed by replication lag
+func (s *CommandStream) expireCommands(cmd *RedisCommand) []*RedisCommand {
+	args := cmd.Command
+	now := s.now().UnixMilli()
+
+	switch name := strings.ToUpper(args[0]); name {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if len(args) < 3 {
+			break
+		}
+		unit, base := int64(1000), now
+		if name == "PEXPIRE" {
+			unit = 1
+		} else if name == "EXPIREAT" {
+			base = 0
+		}
+		ms, ok := absoluteMillis(args[2], unit, base)
+		if !ok {
+			break
+		}
+		// NX/XX/GT/LT options are kept
+		cmd.Command = append([]string{"PEXPIREAT", args[1], ms}, args[3:]...)
+	case "SETEX", "PSETEX":
+		if len(args) != 4 {
+			break
+		}
+		unit := int64(1000)
+		if name == "PSETEX" {
+			unit = 1
+		}
+		ms, ok := absoluteMillis(args[2], unit, now)
+		if !ok {
+			break
+		}
+		cmd.Command = []string{"SET", args[1], args[3]}
+		return []*RedisCommand{cmd, expireCommand(cmd, ms)}
+	case "SET":
+		return setCommands(cmd, now)
+	}
+
+	return []*RedisCommand{cmd}
+}
+
+// SET with EX/PX/EXAT/PXAT becomes SET followed by PEXPIREAT, NX/XX/GET are dropped as master already applied SET
+func setCommands(cmd *RedisCommand, now int64) []*RedisCommand {
+	args := cmd.Command
+	if len(args) < 3 {
+		return []*RedisCommand{cmd}
+	}
+
+	command := []string{"SET", args[1], args[2]}
+	ms := ""
+	for i := 3; i < len(args); i++ {
+		var unit, base int64
+		switch strings.ToUpper(args[i]) {
+		case "EX":
+			unit, base = 1000, now
+		case "PX":
+			unit, base = 1, now
+		case "EXAT":
+			unit = 1000
+		case "PXAT":
+			unit = 1
+		case "NX", "XX", "GET":
+			continue
+		default:
+			command = append(command, args[i])
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return []*RedisCommand{cmd}
+		}
+		value, ok := absoluteMillis(args[i+1], unit, base)
+		if !ok {
+			return []*RedisCommand{cmd}
+		}
+		ms = value
+		i++
+	}
+
+	cmd.Command = command
+	if ms == "" {
+		return []*RedisCommand{cmd}
+	}
+	return []*RedisCommand{cmd, expireCommand(cmd, ms)}
+}
+
+// unix time in ms of value given in unit (1000 for seconds) after base
+func absoluteMillis(value string, unit int64, base int64) (string, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatInt(base+n*unit, 10), true
+}
+
+// PEXPIREAT of key of cmd
+func expireCommand(cmd *RedisCommand, ms string) *RedisCommand {
+	return &RedisCommand{Command: []string{"PEXPIREAT", cmd.Key, ms}, Key: cmd.Key, DB: cmd.DB}
+}
+
+// sameOwner tells whether every key of multi-key command has owner of its first key
+func (cmd *RedisCommand) sameOwner(owner func(key string) string) bool {
+	if len(cmd.Keys) < 2 {
+		return true
+	}
+	first := owner(cmd.Keys[0])
+	for _, key := range cmd.Keys[1:] {
+		if owner(key) != first {
+			return false
+		}
+	}
+	return true
+}
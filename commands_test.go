@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandStream(t *testing.T) {
+	// commands of master
+	stream := NewCommandStream()
+	stream.applied = true
+	stream.now = func() time.Time {
+		return time.UnixMilli(1700000000000)
+	}
+
+	cases := []struct {
+		args     string
+		expected []string
+	}{
+		{"SET foo bar", []string{"foo: SET foo bar"}},
+		{"SET foo bar NX EX 10", []string{"foo: SET foo bar", "foo: PEXPIREAT foo 1700000010000"}},
+		{"SET foo bar KEEPTTL XX", []string{"foo: SET foo bar KEEPTTL"}},
+		{"SET foo bar PXAT 1800000000000 GET", []string{"foo: SET foo bar", "foo: PEXPIREAT foo 1800000000000"}},
+		{"SETEX foo 10 bar", []string{"foo: SET foo bar", "foo: PEXPIREAT foo 1700000010000"}},
+		{"PSETEX foo 10 bar", []string{"foo: SET foo bar", "foo: PEXPIREAT foo 1700000000010"}},
+		{"EXPIRE foo 5 NX", []string{"foo: PEXPIREAT foo 1700000005000 NX"}},
+		{"PEXPIRE foo 5", []string{"foo: PEXPIREAT foo 1700000000005"}},
+		{"EXPIREAT foo 1800000000", []string{"foo: PEXPIREAT foo 1800000000000"}},
+		{"PEXPIREAT foo 1800000000000", []string{"foo: PEXPIREAT foo 1800000000000"}},
+		{"DEL a b", []string{"a: DEL a", "b: DEL b"}},
+		{"MSETNX a 1 b 2", []string{"a: MSET a 1", "b: MSET b 2"}},
+		{"XGROUP CREATE s g $", []string{"s: XGROUP CREATE s g $"}},
+		{"BITOP AND dest a b", []string{"dest: BITOP AND dest a b"}},
+		{"EVAL script 2 k1 k2 arg", []string{"k1: EVAL script 2 k1 k2 arg"}},
+		{"EVAL script 0", nil},
+		{"BLPOP a b 0", []string{"a: BLPOP a b 0"}},
+		{"LMPOP 2 a b LEFT", []string{"a: LMPOP 2 a b LEFT"}},
+		{"BZMPOP 1 2 z1 z2 MIN", []string{"z1: BZMPOP 1 2 z1 z2 MIN"}},
+		{"HPEXPIREAT h 1800000000000 FIELDS 1 f", []string{"h: HPEXPIREAT h 1800000000000 FIELDS 1 f"}},
+		{"FLUSHALL", []string{": FLUSHALL"}},
+		{"CLIENT SETNAME x", nil},
+		{"PING", nil},
+	}
+
+	for _, c := range cases {
+		output := make(chan *RedisCommand, 10)
+		if err := stream.Process(strings.Fields(c.args), output); err != nil {
+			t.Fatal(err)
+		}
+		close(output)
+
+		var got []string
+		for cmd := range output {
+			got = append(got, cmd.Key+": "+strings.Join(cmd.Command, " "))
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s gives %q, expected %q", c.args, got, c.expected)
+		}
+	}
+}
+
+func TestCommandStreamMulti(t *testing.T) {
+	stream := NewCommandStream()
+	output := make(chan *RedisCommand, 10)
+
+	for _, args := range []string{"SELECT 3", "MULTI", "INCR a", "INCR b"} {
+		if err := stream.Process(strings.Fields(args), output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(output) != 0 {
+		t.Fatalf("%d commands of transaction sent before EXEC", len(output))
+	}
+
+	if err := stream.Process([]string{"EXEC"}, output); err != nil {
+		t.Fatal(err)
+	}
+	if len(output) != 2 {
+		t.Fatalf("%d commands of transaction sent, expected 2", len(output))
+	}
+	for i := 0; i < 2; i++ {
+		if cmd := <-output; cmd.DB != 3 {
+			t.Errorf("%v is in db %d", cmd.Command, cmd.DB)
+		}
+	}
+
+	if err := stream.Process([]string{"SELECT", "x"}, output); err == nil {
+		t.Errorf("bad SELECT accepted")
+	}
+}
+
+func TestCommandStreamKeys(t *testing.T) {
+	stream := NewCommandStream()
+	stream.offset = 100
+	output := make(chan *RedisCommand, 10)
+
+	for _, args := range []string{"RENAME a b", "EVAL script 2 k1 k2 arg", "SET foo bar", "ZUNIONSTORE d 2 s1 s2 WEIGHTS 1 2",
+		"SORT src BY w_* GET store LIMIT 0 10 STORE dst", "SORT src GET #", "GEORADIUS g 15 37 200 km COUNT 5 STOREDIST gd",
+		"GEORADIUSBYMEMBER g store 200 km STORE gs", "SELECT 2", "FLUSHDB", "FUNCTION FLUSH"} {
+		if err := stream.Process(strings.Fields(args), output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(output)
+
+	var cmds []*RedisCommand
+	for cmd := range output {
+		cmds = append(cmds, cmd)
+	}
+	if len(cmds) != 10 {
+		t.Fatalf("%d commands", len(cmds))
+	}
+	if !reflect.DeepEqual(cmds[0].Keys, []string{"a", "b"}) || !reflect.DeepEqual(cmds[1].Keys, []string{"k1", "k2"}) || cmds[2].Keys != nil {
+		t.Errorf("keys %q %q %q", cmds[0].Keys, cmds[1].Keys, cmds[2].Keys)
+	}
+	// destination and sources, SORT writes its STORE destination
+	if !reflect.DeepEqual(cmds[3].Keys, []string{"d", "s1", "s2"}) || !reflect.DeepEqual(cmds[4].Keys, []string{"src", "dst"}) || cmds[5].Keys != nil {
+		t.Errorf("keys %q %q %q", cmds[3].Keys, cmds[4].Keys, cmds[5].Keys)
+	}
+	// member named store isn't taken for option
+	if !reflect.DeepEqual(cmds[6].Keys, []string{"g", "gd"}) || !reflect.DeepEqual(cmds[7].Keys, []string{"g", "gs"}) {
+		t.Errorf("keys %q %q", cmds[6].Keys, cmds[7].Keys)
+	}
+	// keyless writes go to every node of their db
+	if !cmds[8].AllNodes || cmds[8].DB != 2 || !cmds[9].AllNodes || cmds[2].AllNodes {
+		t.Errorf("FLUSHDB %+v, FUNCTION %+v", cmds[8], cmds[9])
+	}
+	for _, cmd := range cmds {
+		if cmd.Offset != 100 {
+			t.Errorf("%q offset %d", cmd.Command, cmd.Offset)
+		}
+	}
+}
+
+func TestSameOwner(t *testing.T) {
+	owner := func(key string) string { return key[:1] }
+	for _, c := range []struct {
+		keys []string
+		same bool
+	}{
+		{nil, true},
+		{[]string{"a1", "a2"}, true},
+		{[]string{"a1", "a2", "b1"}, false},
+	} {
+		if same := (&RedisCommand{Keys: c.keys}).sameOwner(owner); same != c.same {
+			t.Errorf("%q: %v", c.keys, same)
+		}
+	}
+}
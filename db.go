@@ -0,0 +1,239 @@
+package main
+
+// Source databases: keys of every db are sent to their own db, a mapped db or db 0 with per-db key prefix
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// first collisions are printed with their key, the rest is only counted
+const dbMaxReportedCollisions = 10
+
+var (
+	// ErrDBMode is returned for -db-mode other than ignore, select and prefix
+	ErrDBMode = errors.New("db: unknown -db-mode, expected ignore, select or prefix")
+	// ErrSelectTarget is returned when select mode is used with target which has only db 0
+	ErrSelectTarget = errors.New("db: cluster and twemproxy have only db 0, use -db-mode prefix")
+	// ErrBadDBMap is returned when -db-map can't be parsed
+	ErrBadDBMap = errors.New("db: bad -db-map, expected source:target,...")
+	// ErrDBCommand is counted for FLUSHDB and SWAPDB whose source db isn't kept apart on target, they aren't sent
+	ErrDBCommand = redis.Error("DBMODE FLUSHDB and SWAPDB need -db-mode select, not sent")
+)
+
+// DBTarget decides target db of every command, keys of different source dbs ending in the same target db are reported
+type DBTarget struct {
+	target Target
+
+	// ignore: everything goes to db 0, select: db of key or its mapping, prefix: db 0 with key prefixed
+	mode    string
+	mapping map[int]int
+	prefix  string
+
+	// source db of keys by hash of target db and key, -1 once collision was reported
+	track      bool
+	owners     map[uint64]int
+	collisions int64
+}
+
+// NewDBTarget wraps target, prefix is format with %d for source db, mapping is used in select mode,
+// collisions are checked when check is set, it takes memory for every key
+func NewDBTarget(target Target, mode string, mapping map[int]int, prefix string, check bool) (*DBTarget, error) {
+	if mode != "ignore" && mode != "select" && mode != "prefix" {
+		return nil, ErrDBMode
+	}
+
+	// in select mode dbs collide only when mapped to the same db, unmapped db stays where it is
+	track := mode != "select"
+	seen := map[int]bool{}
+	for from, to := range mapping {
+		if _, mapped := mapping[to]; seen[to] || (to != from && !mapped) {
+			track = true
+		}
+		seen[to] = true
+	}
+
+	return &DBTarget{
+		target:  target,
+		mode:    mode,
+		mapping: mapping,
+		prefix:  prefix,
+		track:   track && check,
+		owners:  map[uint64]int{},
+	}, nil
+}
+
+// Send sets db of command and rewrites its keys in prefix mode
+func (t *DBTarget) Send(cmd *RedisCommand) error {
+	source := cmd.DB
+
+	switch t.mode {
+	case "ignore":
+		cmd.DB = 0
+	case "select":
+		cmd.DB = t.targetDB(source)
+	case "prefix":
+		if source != 0 {
+			prefixKeys(cmd, fmt.Sprintf(t.prefix, source))
+		}
+		cmd.DB = 0
+	}
+
+	if t.track {
+		t.checkCollision(cmd, source)
+	}
+	return t.target.Send(cmd)
+}
+
+// SendAll forwards command without key, FLUSHDB and SWAPDB go to mapped dbs and only when dbs are kept apart,
+// otherwise they would drop keys of other source dbs
+func (t *DBTarget) SendAll(cmd *RedisCommand) error {
+	name := strings.ToUpper(cmd.Command[0])
+	if name != "FLUSHDB" && name != "SWAPDB" {
+		return t.target.SendAll(cmd)
+	}
+
+	switch {
+	case t.mode == "select":
+		cmd.DB = t.targetDB(cmd.DB)
+		if name == "SWAPDB" && len(cmd.Command) == 3 {
+			args := append([]string{}, cmd.Command...)
+			for i := 1; i < 3; i++ {
+				if db, err := strconv.Atoi(args[i]); err == nil {
+					args[i] = strconv.Itoa(t.targetDB(db))
+				}
+			}
+			cmd.Command = args
+		}
+	case t.mode == "ignore" && name == "FLUSHDB" && cmd.DB == 0 && len(t.mapping) == 0:
+	default:
+		t.target.Stats().record(cmd, ErrDBCommand)
+		return nil
+	}
+	return t.target.SendAll(cmd)
+}
+
+// db of target for source db in select mode
+func (t *DBTarget) targetDB(source int) int {
+	if to, ok := t.mapping[source]; ok {
+		return to
+	}
+	return source
+}
+
+// prefix every key argument of command
+func prefixKeys(cmd *RedisCommand, prefix string) {
+	args := append([]string{}, cmd.Command...)
+
+	var keys []int
+	if spec, ok := keySpecs[strings.ToUpper(args[0])]; ok {
+		keys = spec.keys(args)
+	} else if len(args) > 1 && args[1] == cmd.Key {
+		keys = []int{1}
+	}
+	for _, i := range keys {
+		args[i] = prefix + args[i]
+	}
+
+	cmd.Command = args
+	cmd.Key = prefix + cmd.Key
+
+	if len(cmd.Keys) > 0 {
+		keys := make([]string, len(cmd.Keys))
+		for i, key := range cmd.Keys {
+			keys[i] = prefix + key
+		}
+		cmd.Keys = keys
+	}
+}
+
+// key written from another source db to the same target db is collision
+func (t *DBTarget) checkCollision(cmd *RedisCommand, source int) {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.Itoa(cmd.DB)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(cmd.Key))
+	sum := hash.Sum64()
+
+	owner, ok := t.owners[sum]
+	if !ok {
+		t.owners[sum] = source
+		return
+	}
+	if owner == source || owner < 0 {
+		return
+	}
+
+	t.collisions++
+	if t.collisions <= dbMaxReportedCollisions {
+		fmt.Fprintf(os.Stderr, "db: key %q of db %d overwrites key of db %d in db %d\n", cmd.Key, source, owner, cmd.DB)
+	}
+	t.owners[sum] = -1
+}
+
+// Collisions returns number of keys present in several source dbs
+func (t *DBTarget) Collisions() int64 {
+	return t.collisions
+}
+
+// Flush writes queued commands
+func (t *DBTarget) Flush() error {
+	return t.target.Flush()
+}
+
+// Close closes target and reports collisions
+func (t *DBTarget) Close() error {
+	if t.collisions > 0 {
+		fmt.Fprintf(os.Stderr, "db: %d keys collided across databases\n", t.collisions)
+	}
+	return t.target.Close()
+}
+
+// Stats returns stats of target
+func (t *DBTarget) Stats() *SendStats {
+	return t.target.Stats()
+}
+
+// parseDBMap parses source:target pairs separated by commas
+func parseDBMap(s string) (map[int]int, error) {
+	mapping := map[int]int{}
+	if s == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, ErrBadDBMap
+		}
+		source, err := strconv.Atoi(from)
+		if err != nil || source < 0 {
+			return nil, ErrBadDBMap
+		}
+		target, err := strconv.Atoi(to)
+		if err != nil || target < 0 {
+			return nil, ErrBadDBMap
+		}
+		mapping[source] = target
+	}
+	return mapping, nil
+}
+
+// dbTarget wraps target according to -db-mode, -db-map and -db-prefix
+func dbTarget(target Target) (Target, error) {
+	if DBMode == "select" && (Cluster || NutcrackerConf != "") {
+		return nil, ErrSelectTarget
+	}
+
+	mapping, err := parseDBMap(DBMap)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBTarget(target, DBMode, mapping, DBPrefix, DBCollisions)
+}
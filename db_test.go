@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestDBTargetSelect(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	addr := fakeRedis(t, func(args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, strings.Join(args, " "))
+	})
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := NewDBTarget(newSingleTarget(conn, 4, NewSendStats(), nil), "select", map[int]int{3: 5, 5: 3}, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.track {
+		t.Error("collisions tracked for distinct dbs")
+	}
+
+	for i, db := range []int{0, 3, 3, 2, 0} {
+		key := string(rune('a' + i))
+		if err := target.Send(&RedisCommand{Command: []string{"SET", key, "v"}, Key: key, DB: db}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"SET a v", "SELECT 5", "SET b v", "SET c v", "SELECT 2", "SET d v", "SELECT 0", "SET e v"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %q", received)
+	}
+	// SELECT isn't counted
+	if stats := target.Stats(); stats.OK() != 5 || stats.Failed() != 0 {
+		t.Errorf("%d ok and %d failed", stats.OK(), stats.Failed())
+	}
+}
+
+func TestDBTargetPrefix(t *testing.T) {
+	record := &recordTarget{}
+	target, err := NewDBTarget(record, "prefix", nil, "db%d:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := []*RedisCommand{
+		{Command: []string{"RESTORE", "x", "0", "payload"}, Key: "x", DB: 0},
+		{Command: []string{"RESTORE", "x", "0", "payload"}, Key: "x", DB: 2},
+		{Command: []string{"RENAME", "a", "b"}, Key: "a", DB: 1},
+		{Command: []string{"XGROUP", "CREATE", "s", "g", "0"}, Key: "s", DB: 1},
+		// same key as x of db 2
+		{Command: []string{"SET", "db2:x", "v"}, Key: "db2:x", DB: 0},
+	}
+	for _, cmd := range cmds {
+		if err := target.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, cmd := range record.cmds {
+		if cmd.DB != 0 {
+			t.Errorf("%q sent to db %d", cmd.Command, cmd.DB)
+		}
+		got = append(got, cmd.Key+": "+strings.Join(cmd.Command, " "))
+	}
+	expected := []string{
+		"x: RESTORE x 0 payload",
+		"db2:x: RESTORE db2:x 0 payload",
+		"db1:a: RENAME db1:a db1:b",
+		"db1:s: XGROUP CREATE db1:s g 0",
+		"db2:x: SET db2:x v",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("sent %q", got)
+	}
+	if target.Collisions() != 1 {
+		t.Errorf("%d collisions, expected 1", target.Collisions())
+	}
+}
+
+func TestDBTargetIgnore(t *testing.T) {
+	record := &recordTarget{}
+	target, err := NewDBTarget(record, "ignore", nil, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, db := range []int{0, 0, 1, 1, 2} {
+		if err := target.Send(&RedisCommand{Command: []string{"SET", "k", "v"}, Key: "k", DB: db}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// key is reported once
+	if target.Collisions() != 1 {
+		t.Errorf("%d collisions, expected 1", target.Collisions())
+	}
+
+	// without check no key is kept
+	unchecked, _ := NewDBTarget(&recordTarget{}, "ignore", nil, "", false)
+	for _, db := range []int{0, 1} {
+		if err := unchecked.Send(&RedisCommand{Command: []string{"SET", "k", "v"}, Key: "k", DB: db}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unchecked.Collisions() != 0 || len(unchecked.owners) != 0 {
+		t.Errorf("%d collisions, %d keys tracked without check", unchecked.Collisions(), len(unchecked.owners))
+	}
+
+	if _, err := NewDBTarget(record, "merge", nil, "", true); err != ErrDBMode {
+		t.Errorf("unknown mode: %v", err)
+	}
+}
+
+func TestDBTargetFlush(t *testing.T) {
+	record := &recordTarget{}
+	target, _ := NewDBTarget(record, "select", map[int]int{3: 5}, "", false)
+	for _, cmd := range []*RedisCommand{
+		{Command: []string{"FLUSHDB"}, DB: 3, AllNodes: true},
+		{Command: []string{"SWAPDB", "3", "1"}, DB: 0, AllNodes: true},
+		{Command: []string{"FLUSHALL"}, DB: 3, AllNodes: true},
+	} {
+		if err := target.SendAll(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, cmd := range record.cmds {
+		got = append(got, fmt.Sprintf("%d: %s", cmd.DB, strings.Join(cmd.Command, " ")))
+	}
+	if expected := []string{"5: FLUSHDB", "0: SWAPDB 5 1", "3: FLUSHALL"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("sent %q", got)
+	}
+
+	// dbs merged into db 0 or renamed, FLUSHDB of db 1 would drop keys of other dbs
+	for _, mode := range []string{"ignore", "prefix"} {
+		record := &recordTarget{}
+		target, _ := NewDBTarget(record, mode, nil, "db%d:", false)
+		target.SendAll(&RedisCommand{Command: []string{"FLUSHDB"}, DB: 1, AllNodes: true})
+		if len(record.cmds) != 0 || record.Stats().Failed() != 1 {
+			t.Errorf("%s: FLUSHDB of db 1 sent %d times, %d failed", mode, len(record.cmds), record.Stats().Failed())
+		}
+	}
+}
+
+func TestParseDBMap(t *testing.T) {
+	mapping, err := parseDBMap("3:0, 4:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping, map[int]int{3: 0, 4: 1}) {
+		t.Errorf("mapping %v", mapping)
+	}
+
+	for _, s := range []string{"3", "a:1", "3:-1"} {
+		if _, err := parseDBMap(s); err != ErrBadDBMap {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+
+	// db 0 would get keys of db 0 and db 3
+	target, _ := NewDBTarget(&recordTarget{}, "select", map[int]int{3: 0}, "", true)
+	if !target.track {
+		t.Error("collisions not tracked for db mapped to unmapped db")
+	}
+}
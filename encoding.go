@@ -0,0 +1,312 @@
+package main
+
+// Decoders for compact encodings stored as RDB strings: ziplist, zipmap, intset and listpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	zipmapBigLen = 254
+	zipmapEnd    = 255
+
+	ziplistEnd     = 0xFF
+	ziplistBigLen  = 0xFE
+	ziplistHeader  = 10
+	listpackHeader = 6
+	listpackEnd    = 0xFF
+)
+
+var (
+	// ErrCorruptEncoding is returned when ziplist, zipmap, intset or listpack can't be decoded
+	ErrCorruptEncoding = errors.New("rdb: corrupt compact encoding")
+)
+
+// decodeZiplist returns all entries of ziplist as strings
+func decodeZiplist(data []byte) ([]string, error) {
+	if len(data) < ziplistHeader+1 {
+		return nil, ErrCorruptEncoding
+	}
+
+	var result []string
+	pos := ziplistHeader
+
+	for {
+		if pos >= len(data) {
+			return nil, ErrCorruptEncoding
+		}
+		if data[pos] == ziplistEnd {
+			return result, nil
+		}
+
+		// previous entry length
+		if data[pos] == ziplistBigLen {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, ErrCorruptEncoding
+		}
+
+		entry, n, err := decodeZiplistEntry(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+		pos += n
+	}
+}
+
+// decode single ziplist entry, returns entry and number of consumed bytes
+func decodeZiplistEntry(data []byte) (string, int, error) {
+	header := data[0]
+
+	switch header >> 6 {
+	case 0: // 00pppppp
+		return ziplistString(data, 1, int(header&0x3F))
+	case 1: // 01pppppp qqqqqqqq
+		if len(data) < 2 {
+			return "", 0, ErrCorruptEncoding
+		}
+		return ziplistString(data, 2, int(header&0x3F)<<8|int(data[1]))
+	case 2: // 10000000 qqqqqqqq rrrrrrrr ssssssss tttttttt
+		if len(data) < 5 {
+			return "", 0, ErrCorruptEncoding
+		}
+		return ziplistString(data, 5, int(binary.BigEndian.Uint32(data[1:5])))
+	}
+
+	var size int
+	switch header {
+	case 0xC0: // int16
+		size = 2
+	case 0xD0: // int32
+		size = 4
+	case 0xE0: // int64
+		size = 8
+	case 0xF0: // int24
+		size = 3
+	case 0xFE: // int8
+		size = 1
+	default:
+		// 1111xxxx, immediate 4 bit integer
+		if header >= 0xF1 && header <= 0xFD {
+			return strconv.Itoa(int(header&0x0F) - 1), 1, nil
+		}
+		return "", 0, ErrCorruptEncoding
+	}
+
+	if len(data) < 1+size {
+		return "", 0, ErrCorruptEncoding
+	}
+	return strconv.FormatInt(littleEndianInt(data[1:1+size]), 10), 1 + size, nil
+}
+
+func ziplistString(data []byte, offset int, length int) (string, int, error) {
+	if len(data) < offset+length {
+		return "", 0, ErrCorruptEncoding
+	}
+	return string(data[offset : offset+length]), offset + length, nil
+}
+
+// decodeZipmap returns zipmap as flat field, value list
+func decodeZipmap(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, ErrCorruptEncoding
+	}
+
+	var result []string
+	pos := 1 // zmlen
+
+	for {
+		if pos >= len(data) {
+			return nil, ErrCorruptEncoding
+		}
+		if data[pos] == zipmapEnd {
+			return result, nil
+		}
+
+		// field
+		field, n, err := zipmapString(data[pos:], false)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+		if pos >= len(data) {
+			return nil, ErrCorruptEncoding
+		}
+
+		// value, followed by free bytes
+		value, n, err := zipmapString(data[pos:], true)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+
+		result = append(result, field, value)
+	}
+}
+
+// decode zipmap length prefixed string, value strings carry trailing free space
+func zipmapString(data []byte, value bool) (string, int, error) {
+	pos := 1
+	length := int(data[0])
+	if data[0] == zipmapBigLen {
+		if len(data) < 5 {
+			return "", 0, ErrCorruptEncoding
+		}
+		length = int(binary.LittleEndian.Uint32(data[1:5]))
+		pos = 5
+	}
+
+	free := 0
+	if value {
+		if len(data) <= pos {
+			return "", 0, ErrCorruptEncoding
+		}
+		free = int(data[pos])
+		pos++
+	}
+
+	if len(data) < pos+length+free {
+		return "", 0, ErrCorruptEncoding
+	}
+	return string(data[pos : pos+length]), pos + length + free, nil
+}
+
+// decodeIntset returns intset members as strings
+func decodeIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, ErrCorruptEncoding
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[0:4]))
+	count := int(binary.LittleEndian.Uint32(data[4:8]))
+	if size != 2 && size != 4 && size != 8 {
+		return nil, ErrCorruptEncoding
+	}
+	if len(data) < 8+size*count {
+		return nil, ErrCorruptEncoding
+	}
+
+	result := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		offset := 8 + i*size
+		result = append(result, strconv.FormatInt(littleEndianInt(data[offset:offset+size]), 10))
+	}
+	return result, nil
+}
+
+// decodeListpack returns all entries of listpack as strings
+func decodeListpack(data []byte) ([]string, error) {
+	if len(data) < listpackHeader+1 {
+		return nil, ErrCorruptEncoding
+	}
+
+	var result []string
+	pos := listpackHeader
+
+	for {
+		if pos >= len(data) {
+			return nil, ErrCorruptEncoding
+		}
+		if data[pos] == listpackEnd {
+			return result, nil
+		}
+
+		entry, n, err := decodeListpackEntry(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+
+		// skip entry and its backlen
+		pos += n + listpackBacklenSize(n)
+	}
+}
+
+// decode single listpack entry, returns entry and encoded length without backlen
+func decodeListpackEntry(data []byte) (string, int, error) {
+	header := data[0]
+
+	switch {
+	case header&0x80 == 0: // 0xxxxxxx, 7 bit uint
+		return strconv.Itoa(int(header)), 1, nil
+	case header&0xC0 == 0x80: // 10xxxxxx, 6 bit string length
+		return listpackString(data, 1, int(header&0x3F))
+	case header&0xE0 == 0xC0: // 110xxxxx yyyyyyyy, 13 bit int
+		if len(data) < 2 {
+			return "", 0, ErrCorruptEncoding
+		}
+		value := int64(header&0x1F)<<8 | int64(data[1])
+		if value >= 1<<12 {
+			value -= 1 << 13
+		}
+		return strconv.FormatInt(value, 10), 2, nil
+	case header&0xF0 == 0xE0: // 1110xxxx yyyyyyyy, 12 bit string length
+		if len(data) < 2 {
+			return "", 0, ErrCorruptEncoding
+		}
+		return listpackString(data, 2, int(header&0x0F)<<8|int(data[1]))
+	}
+
+	var size int
+	switch header {
+	case 0xF0: // 32 bit string length
+		if len(data) < 5 {
+			return "", 0, ErrCorruptEncoding
+		}
+		return listpackString(data, 5, int(binary.LittleEndian.Uint32(data[1:5])))
+	case 0xF1: // int16
+		size = 2
+	case 0xF2: // int24
+		size = 3
+	case 0xF3: // int32
+		size = 4
+	case 0xF4: // int64
+		size = 8
+	default:
+		return "", 0, ErrCorruptEncoding
+	}
+
+	if len(data) < 1+size {
+		return "", 0, ErrCorruptEncoding
+	}
+	return strconv.FormatInt(littleEndianInt(data[1:1+size]), 10), 1 + size, nil
+}
+
+func listpackString(data []byte, offset int, length int) (string, int, error) {
+	if len(data) < offset+length {
+		return "", 0, ErrCorruptEncoding
+	}
+	return string(data[offset : offset+length]), offset + length, nil
+}
+
+// number of bytes used to store backlen of entry with encoded length n, limits of lpEncodeBacklen
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// read signed little endian integer of 1 to 8 bytes
+func littleEndianInt(data []byte) int64 {
+	var value uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	shift := uint(64 - 8*len(data))
+	return int64(value<<shift) >> shift
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListpackBacklenSize(t *testing.T) {
+	for n, size := range map[int]int{
+		1: 1, 127: 1,
+		128: 2, 16382: 2,
+		16383: 3, 2097150: 3,
+		2097151: 4, 268435454: 4,
+		268435455: 5,
+	} {
+		if got := listpackBacklenSize(n); got != size {
+			t.Errorf("backlen of %d takes %d bytes, expected %d", n, got, size)
+		}
+	}
+}
+
+func TestDecodeListpack(t *testing.T) {
+	// entries of encoded length 16383 have backlen of 3 bytes
+	long := strings.Repeat("x", 16383-5)
+	data := make([]byte, listpackHeader)
+	data = append(data, 0xF0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], uint32(len(long)))
+	data = append(data, long...)
+	data = append(data, 0x7F, 0xFF, 0x01)
+	// 7 bit uint and its backlen
+	data = append(data, 5, 1, listpackEnd)
+
+	entries, err := decodeListpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []string{long, "5"}) {
+		t.Errorf("%d entries", len(entries))
+	}
+}
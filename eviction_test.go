@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// keys hot, cold and plain, with LRU idle time, LFU counter and none
+func evictionRDB() []byte {
+	key := func(name string) []byte {
+		return append(append([]byte{rdbOpString}, rdbString(name)...), rdbString("v")...)
+	}
+	return buildRDB(9,
+		append([]byte{rdbOpIdle}, encodeLength(30)...), key("hot"),
+		append([]byte{rdbOpIdle}, encodeLength(7200)...), key("cold"),
+		[]byte{rdbOpFreq, 3}, key("rare"),
+		key("plain"),
+	)
+}
+
+func TestEviction(t *testing.T) {
+	defer func(replace bool) { Replace = replace }(Replace)
+
+	expected := [][]string{{"IDLETIME", "30"}, {"IDLETIME", "7200"}, {"FREQ", "3"}, nil}
+	for _, Replace = range []bool{false, true} {
+		cmds := parseRDBCommands(t, evictionRDB())
+		if len(cmds) != 4 {
+			t.Fatalf("%d commands", len(cmds))
+		}
+
+		for i, cmd := range cmds {
+			// REPLACE comes before the options
+			var options []string
+			for j, arg := range cmd.Command {
+				if arg == "IDLETIME" || arg == "FREQ" {
+					options = cmd.Command[j:]
+					break
+				}
+			}
+			if !reflect.DeepEqual(options, expected[i]) {
+				t.Errorf("%s options %q, expected %q", cmd.Key, options, expected[i])
+			}
+			if replace := len(cmd.Command) > 4 && cmd.Command[4] == "REPLACE"; replace != Replace {
+				t.Errorf("%s: %q with replace %v", cmd.Key, cmd.Command, Replace)
+			}
+		}
+	}
+}
+
+func TestEvictionCold(t *testing.T) {
+	MaxIdle, MinFreq = time.Hour, 5
+	defer func() { MaxIdle, MinFreq = 0, 0 }()
+
+	var keys []string
+	for _, cmd := range parseRDBCommands(t, evictionRDB()) {
+		keys = append(keys, cmd.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"hot", "plain"}) {
+		t.Errorf("keys %q", keys)
+	}
+}
+
+func TestEvictionRDBWriter(t *testing.T) {
+	rdb := evictionRDB()
+	entries := make(chan *RDBEntry, 10)
+	if err := ParseEntries(bufio.NewReader(bytes.NewReader(rdb)), entries); err != nil {
+		t.Fatal(err)
+	}
+	close(entries)
+
+	var buf bytes.Buffer
+	writer, err := NewRDBWriter(&buf, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry := range entries {
+		if err := writer.WriteEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	// SELECTDB 0 is added in front of first key
+	expected := buildRDB(9, []byte{rdbOpDB, 0}, rdb[9:len(rdb)-9])
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("RDB %q, expected %q", buf.Bytes(), expected)
+	}
+}
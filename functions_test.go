@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLibrary = "#!lua name=mylib\nredis.register_function('f', function() return 1 end)"
+
+// RDB string without encoding
+func rdbString(s string) []byte {
+	return append(encodeLength(uint64(len(s))), s...)
+}
+
+// RDB of version with body between header and EOF
+func buildRDB(version int, parts ...[]byte) []byte {
+	rdb := []byte(fmt.Sprintf("REDIS%04d", version))
+	for _, part := range parts {
+		rdb = append(rdb, part...)
+	}
+	rdb = append(rdb, rdbOpEOF)
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, CRC64Update(0, rdb))
+	return append(rdb, crc...)
+}
+
+func functionsRDB() []byte {
+	return buildRDB(10,
+		append(append([]byte{rdbOpAux}, rdbString("lua")...), rdbString("return 1")...),
+		append([]byte{rdbOpFunctionPreGA}, bytes.Join([][]byte{rdbString("old"), rdbString("LUA"), {1}, rdbString("desc"), rdbString("return 1")}, nil)...),
+		append([]byte{rdbOpFunction2}, rdbString(testLibrary)...),
+		append(append([]byte{rdbOpString}, rdbString("k")...), rdbString("v")...),
+	)
+}
+
+func parseRDBCommands(t *testing.T, rdb []byte) []*RedisCommand {
+	output := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseRDB(bufio.NewReader(bytes.NewReader(rdb)), output, nil)
+		close(output)
+	}()
+
+	var cmds []*RedisCommand
+	for cmd := range output {
+		cmds = append(cmds, cmd)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+func TestFunctions(t *testing.T) {
+	defer func(replace bool) { Replace = replace }(Replace)
+	Replace = true
+
+	cmds := parseRDBCommands(t, functionsRDB())
+	if len(cmds) != 3 {
+		t.Fatalf("%d commands", len(cmds))
+	}
+
+	if !reflect.DeepEqual(cmds[0].Command, []string{"SCRIPT", "LOAD", "return 1"}) || !cmds[0].AllNodes {
+		t.Errorf("script %q", cmds[0].Command)
+	}
+
+	restore := cmds[1].Command
+	if len(restore) != 4 || restore[0] != "FUNCTION" || restore[1] != "RESTORE" || restore[3] != "REPLACE" || !cmds[1].AllNodes {
+		t.Fatalf("function %q", restore)
+	}
+	// opcode, code, version and checksum of everything before it
+	payload := []byte(restore[2])
+	expected := append(append([]byte{rdbOpFunction2}, rdbString(testLibrary)...), 10, 0)
+	if !bytes.Equal(payload[:len(payload)-8], expected) {
+		t.Errorf("payload %q", payload)
+	}
+	if binary.LittleEndian.Uint64(payload[len(payload)-8:]) != CRC64Update(0, expected) {
+		t.Error("payload checksum")
+	}
+
+	if cmds[2].Key != "k" || cmds[2].AllNodes {
+		t.Errorf("key %q", cmds[2].Command)
+	}
+}
+
+// dump laid out as redis 7.0 saves one library and one key, opcodes as literal bytes of rdb.h: RDB_OPCODE_FUNCTION2
+// is 245 (0xF5)
+const redis7FunctionRDB = "REDIS0010\xfa\x09redis-ver\x067.0.11\xfa\x0aredis-bits\xc0\x40" +
+	"\xf5\x40\x46#!lua name=mylib\nredis.register_function('f', function() return 1 end)" +
+	"\xfe\x00\xfb\x01\x00\x00\x01k\x01v\xff\x59\x2b\xf8\x37\x91\x8b\x34\xef"
+
+func TestFunctionsRedis7(t *testing.T) {
+	defer func(replace bool) { Replace = replace }(Replace)
+	Replace = false
+
+	cmds := parseRDBCommands(t, []byte(redis7FunctionRDB))
+	if len(cmds) != 2 {
+		t.Fatalf("%d commands", len(cmds))
+	}
+	// payload of FUNCTION DUMP starts with the same opcode
+	restore := cmds[0].Command
+	if len(restore) != 4 || restore[1] != "RESTORE" || !strings.HasPrefix(restore[2], "\xf5\x40\x46#!lua name=mylib") {
+		t.Errorf("function %q", restore)
+	}
+	if cmds[1].Key != "k" {
+		t.Errorf("key %q", cmds[1].Command)
+	}
+}
+
+func TestFunctionsNative(t *testing.T) {
+	defer func(native, replace bool) { Native, Replace = native, replace }(Native, Replace)
+	Native, Replace = true, true
+
+	cmds := parseRDBCommands(t, functionsRDB())
+	if !reflect.DeepEqual(cmds[1].Command, []string{"FUNCTION", "LOAD", "REPLACE", testLibrary}) {
+		t.Errorf("function %q", cmds[1].Command)
+	}
+}
+
+func TestFunctionsMetadata(t *testing.T) {
+	metadata, err := ParseRDBMetadata(bufio.NewReader(bytes.NewReader(functionsRDB())), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.Functions, []string{"mylib"}) || metadata.Scripts != 1 {
+		t.Errorf("functions %q, %d scripts", metadata.Functions, metadata.Scripts)
+	}
+}
+
+func TestFunctionsRDBWriter(t *testing.T) {
+	entries := make(chan *RDBEntry, 10)
+	if err := ParseEntries(bufio.NewReader(bytes.NewReader(functionsRDB())), entries); err != nil {
+		t.Fatal(err)
+	}
+	close(entries)
+
+	var buf bytes.Buffer
+	writer, err := NewRDBWriter(&buf, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry := range entries {
+		if err := writer.WriteEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	// function and script cache are kept, pre-release function is dropped
+	expected := buildRDB(10,
+		append(append([]byte{rdbOpAux}, rdbString("lua")...), rdbString("return 1")...),
+		append([]byte{rdbOpFunction2}, rdbString(testLibrary)...),
+		append(append([]byte{rdbOpDB}, 0, rdbOpString), append(rdbString("k"), rdbString("v")...)...),
+	)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("RDB %q, expected %q", buf.Bytes(), expected)
+	}
+}
@@ -2,4 +2,9 @@ module redis-proxy-resharding
 
 go 1.19
 
-require github.com/garyburd/redigo v1.6.4
+require (
+	github.com/garyburd/redigo v1.6.4
+	github.com/klauspost/compress v1.17.4
+	github.com/pierrec/lz4/v4 v4.1.21
+	gopkg.in/yaml.v2 v2.4.0
+)
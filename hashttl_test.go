@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const fieldExpireAt = 1900000000000
+
+// listpack of short strings and int64 entries
+func buildListpack(entries ...interface{}) []byte {
+	var body []byte
+	for _, entry := range entries {
+		switch entry := entry.(type) {
+		case string:
+			body = append(body, 0x80|byte(len(entry)))
+			body = append(body, entry...)
+			body = append(body, byte(1+len(entry)))
+		case uint64:
+			body = append(body, 0xF4)
+			body = binary.LittleEndian.AppendUint64(body, entry)
+			body = append(body, 9)
+		}
+	}
+
+	header := make([]byte, 6)
+	binary.LittleEndian.PutUint32(header, uint32(len(body)+7))
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(entries)))
+	return append(append(header, body...), listpackEnd)
+}
+
+// {a}meta is hash metadata with f1 expiring and f2 not, {a}lpex is listpack-ex with f1 expiring
+func hashMetadataValue() []byte {
+	value := []byte{rdbOpHashMetadata}
+	value = binary.LittleEndian.AppendUint64(value, fieldExpireAt)
+	value = append(value, encodeLength(2)...)
+	value = append(value, encodeLength(1)...)
+	value = append(append(value, rdbString("f1")...), rdbString("v1")...)
+	value = append(value, encodeLength(0)...)
+	return append(append(value, rdbString("f2")...), rdbString("v2")...)
+}
+
+func hashListpackExValue() []byte {
+	value := []byte{rdbOpHashListpackEx}
+	value = binary.LittleEndian.AppendUint64(value, fieldExpireAt)
+	return append(value, rdbString(string(buildListpack("f1", "v1", uint64(fieldExpireAt), "f2", "v2", uint64(0))))...)
+}
+
+func slotInfo(slot int, size uint64) []byte {
+	info := append([]byte{rdbOpSlotInfo}, encodeLength(uint64(slot))...)
+	return append(append(info, encodeLength(size)...), encodeLength(0)...)
+}
+
+func keyValue(key string, value []byte) []byte {
+	return append(append(value[:1:1], rdbString(key)...), value[1:]...)
+}
+
+func hashTTLRDB() []byte {
+	return buildRDB(12,
+		slotInfo(KeyHashSlot("a"), 2),
+		keyValue("{a}meta", hashMetadataValue()),
+		keyValue("{a}lpex", hashListpackExValue()),
+		// key of another slot and wrong slot size
+		slotInfo(KeyHashSlot("b"), 2),
+		keyValue("{c}str", append([]byte{rdbOpString}, rdbString("v")...)),
+	)
+}
+
+func TestHashTTLRestore(t *testing.T) {
+	cmds := parseRDBCommands(t, hashTTLRDB())
+	if len(cmds) != 3 {
+		t.Fatalf("%d commands", len(cmds))
+	}
+
+	for i, value := range [][]byte{hashMetadataValue(), hashListpackExValue()} {
+		payload := []byte(cmds[i].Command[3])
+		expected := append(value, 12, 0)
+		if !bytes.Equal(payload[:len(payload)-8], expected) {
+			t.Errorf("%s payload %q, expected %q", cmds[i].Key, payload, expected)
+		}
+	}
+}
+
+func TestHashTTLNative(t *testing.T) {
+	defer func(native, replace bool) { Native, Replace = native, replace }(Native, Replace)
+	Native, Replace = true, true
+
+	at := strconv.Itoa(fieldExpireAt)
+	expected := [][]string{
+		{"DEL", "{a}meta"},
+		{"HSET", "{a}meta", "f1", "v1", "f2", "v2"},
+		{"HPEXPIREAT", "{a}meta", at, "FIELDS", "1", "f1"},
+		{"DEL", "{a}lpex"},
+		{"HSET", "{a}lpex", "f1", "v1", "f2", "v2"},
+		{"HPEXPIREAT", "{a}lpex", at, "FIELDS", "1", "f1"},
+		{"SET", "{c}str", "v"},
+	}
+
+	var commands [][]string
+	for _, cmd := range parseRDBCommands(t, hashTTLRDB()) {
+		commands = append(commands, cmd.Command)
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("commands %q, expected %q", commands, expected)
+	}
+}
+
+func TestFieldExpireCommands(t *testing.T) {
+	fields := []HashField{{Field: "a", ExpireAt: 2}, {Field: "b"}, {Field: "c", ExpireAt: 1}, {Field: "d", ExpireAt: 2}}
+	expected := [][]string{{"HPEXPIREAT", "h", "2", "FIELDS", "2", "a", "d"}, {"HPEXPIREAT", "h", "1", "FIELDS", "1", "c"}}
+
+	var commands [][]string
+	for _, cmd := range fieldExpireCommands("h", fields) {
+		commands = append(commands, cmd.Command)
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("commands %q, expected %q", commands, expected)
+	}
+}
+
+func TestSlotInfo(t *testing.T) {
+	metadata, err := ParseRDBMetadata(bufio.NewReader(bytes.NewReader(hashTTLRDB())), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Version != 12 || metadata.Slots != 2 || metadata.SlotErrors != 1 {
+		t.Errorf("version %d, %d slots, %d keys outside slot", metadata.Version, metadata.Slots, metadata.SlotErrors)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+// RDB input: file, stdin or socket, read as a stream so memory doesn't depend on dump size, compressed input is detected by magic bytes
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// size of read buffer in front of parser
+const inputBufferSize = 1 << 20
+
+var (
+	// ErrVerifyStream is returned when -verify is used with input which can't be read twice
+	ErrVerifyStream = errors.New("input: -verify needs a file, stdin and sockets can't be read twice")
+	// ErrVerifyMaster is returned when -verify is used with -master, RDB of master is written while it is read
+	ErrVerifyMaster = errors.New("input: -verify can't be used with -master, RDB of master is read only once")
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// Input is RDB stream, decompressed on the fly when source is gzip, zstd or lz4
+type Input struct {
+	*bufio.Reader
+
+	source  io.ReadCloser
+	decoder io.Closer
+	// size of source, 0 when unknown
+	size int64
+	// bytes read from source, before decompression
+	offset int64
+
+	// gzip, zstd, lz4 or empty
+	Compression string
+}
+
+// counts bytes read from source
+type countingReader struct {
+	reader io.Reader
+	offset *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.offset, int64(n))
+	return n, err
+}
+
+// openInput opens path for reading: "-" is stdin, tcp://host:port and unix:///path are sockets, anything else is file
+func openInput(path string) (*Input, error) {
+	source, err := openSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &Input{source: source}
+	if file, ok := source.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			in.size = info.Size()
+		}
+	}
+
+	err = in.decompress(bufio.NewReaderSize(countingReader{source, &in.offset}, inputBufferSize))
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+func openSource(path string) (io.ReadCloser, error) {
+	switch {
+	case path == "-":
+		return io.NopCloser(os.Stdin), nil
+	case strings.HasPrefix(path, "tcp://"):
+		return net.Dial("tcp", strings.TrimPrefix(path, "tcp://"))
+	case strings.HasPrefix(path, "unix://"):
+		return net.Dial("unix", strings.TrimPrefix(path, "unix://"))
+	}
+	return os.Open(path)
+}
+
+// put decoder between reader and parser when magic bytes of compression format are found
+func (in *Input) decompress(reader *bufio.Reader) error {
+	// shorter input can't be compressed RDB, parser reports it
+	magic, _ := reader.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		in.Reader = bufio.NewReaderSize(decoder, inputBufferSize)
+		in.decoder = decoder
+		in.Compression = "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		in.Reader = bufio.NewReaderSize(decoder, inputBufferSize)
+		in.decoder = decoder.IOReadCloser()
+		in.Compression = "zstd"
+	case bytes.HasPrefix(magic, lz4Magic):
+		in.Reader = bufio.NewReaderSize(lz4.NewReader(reader), inputBufferSize)
+		in.Compression = "lz4"
+	default:
+		in.Reader = reader
+	}
+	return nil
+}
+
+// Offset returns bytes read from source, compressed bytes for compressed input
+func (in *Input) Offset() int64 {
+	return atomic.LoadInt64(&in.offset)
+}
+
+// Size returns size of source file, 0 for stdin and sockets
+func (in *Input) Size() int64 {
+	return in.size
+}
+
+// Close closes decoder and source
+func (in *Input) Close() error {
+	if in.decoder != nil {
+		in.decoder.Close()
+	}
+	return in.source.Close()
+}
+
+// print read offset every interval until done is closed
+func (in *Input) reportProgress(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		offset := in.Offset()
+		if in.size > 0 {
+			fmt.Fprintf(os.Stderr, "input: read %d of %d bytes (%.1f%%)\n", offset, in.size, float64(offset)*100/float64(in.size))
+		} else {
+			fmt.Fprintf(os.Stderr, "input: read %d bytes\n", offset)
+		}
+	}
+}
+
+// verifyInput parses whole input without writing anything, so truncated or corrupt dump is found before first write
+func verifyInput(path string, manifest string, format string) error {
+	if path == "-" || strings.HasPrefix(path, "tcp://") || strings.HasPrefix(path, "unix://") {
+		return ErrVerifyStream
+	}
+
+	output := make(chan *RedisCommand, 10)
+	go func() {
+		for range output {
+		}
+	}()
+	defer close(output)
+
+	if manifest != "" {
+		return ParseAOFDir(manifest, output, nil, true)
+	}
+
+	input, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	return parseInput(format, input.Reader, output, nil, true)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// commands parsed from input at path
+func inputCommands(t *testing.T, path string) [][]string {
+	input, err := openInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+
+	output := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseRDB(input.Reader, output, nil)
+		close(output)
+	}()
+
+	var cmds [][]string
+	for cmd := range output {
+		cmds = append(cmds, cmd.Command)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+func TestOpenInput(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(rdb)
+		conn.Close()
+	}()
+
+	expected := inputCommands(t, "./cases/memory.rdb")
+	if len(expected) == 0 {
+		t.Fatal("no commands parsed")
+	}
+	if cmds := inputCommands(t, "tcp://"+listener.Addr().String()); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("%d commands read from socket, expected %d", len(cmds), len(expected))
+	}
+
+	if _, err := openInput("./cases/missing.rdb"); !os.IsNotExist(err) {
+		t.Errorf("missing file opened: %v", err)
+	}
+}
+
+func TestCompressedInput(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := inputCommands(t, "./cases/memory.rdb")
+
+	compressors := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		"lz4":  func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+	}
+	for name, compressor := range compressors {
+		path := filepath.Join(t.TempDir(), "dump.rdb."+name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := compressor(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(rdb)
+		w.Close()
+		file.Close()
+
+		if cmds := inputCommands(t, path); !reflect.DeepEqual(cmds, expected) {
+			t.Errorf("%s: %d commands, expected %d", name, len(cmds), len(expected))
+		}
+
+		input, err := openInput(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if input.Compression != name {
+			t.Errorf("%s detected as %q", name, input.Compression)
+		}
+		io.Copy(io.Discard, input)
+		// offset is of compressed file
+		if input.Offset() != input.Size() {
+			t.Errorf("%s: offset %d at end of %d bytes", name, input.Offset(), input.Size())
+		}
+		input.Close()
+	}
+}
+
+func TestVerifyInput(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	corrupt := append([]byte{}, rdb...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	files := map[string][]byte{
+		"valid.rdb":     rdb,
+		"corrupt.rdb":   corrupt,
+		"truncated.rdb": rdb[:len(rdb)/2],
+		"truncated.aof": append(aofCommands([]string{"SET", "a", "b"}), "*3\r\n$3\r\nSET"...),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := verifyInput(filepath.Join(dir, "valid.rdb"), "", "auto"); err != nil {
+		t.Errorf("valid RDB: %v", err)
+	}
+	if err := verifyInput(filepath.Join(dir, "corrupt.rdb"), "", "rdb"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("corrupt RDB: %v", err)
+	}
+	if err := verifyInput(filepath.Join(dir, "truncated.rdb"), "", "rdb"); err == nil {
+		t.Error("truncated RDB is valid")
+	}
+	if err := verifyInput(filepath.Join(dir, "truncated.aof"), "", "auto"); err != ErrTruncated {
+		t.Errorf("truncated AOF: %v", err)
+	}
+	if err := verifyInput("-", "", "auto"); err != ErrVerifyStream {
+		t.Errorf("stdin: %v", err)
+	}
+}
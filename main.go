@@ -1,23 +1,51 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"io"
 	"os"
+	"time"
 )
 
+const flushInterval = 100 * time.Millisecond
+
 var (
-	SkipRDB       bool
-	Replace       bool
-	Path          string
-	counter       uint64
-	proxyPort     int
-	proxyHost     string
-	proxyPassword string
+	SkipRDB           bool
+	Replace           bool
+	Native            bool
+	Cluster           bool
+	Pipeline          int
+	NutcrackerConf    string
+	NutcrackerPool    string
+	OldNutcrackerConf string
+	OldNutcrackerPool string
+	DeleteMoved       bool
+	PlanOnly          bool
+	Master            string
+	MasterPassword    string
+	Follow            bool
+	LagInterval       time.Duration
+	ProxyReplicas     bool
+	Connections       int
+	ProxyAddrs        string
+	LargeKeySize      int64
+	LargeConnections  int
+	MaxBytesInFlight  int64
+	ProgressInterval  time.Duration
+	Format            string
+	Verify            bool
+	DBMode            string
+	DBMap             string
+	DBPrefix          string
+	DBCollisions      bool
+	MaxIdle           time.Duration
+	MinFreq           int
+	Path              string
+	counter           uint64
+	proxyPort         int
+	proxyHost         string
+	proxyPassword     string
 )
 
 func getConn(addr string, auth string) (redis.Conn, error) {
@@ -30,26 +58,121 @@ func getConn(addr string, auth string) (redis.Conn, error) {
 
 func main() {
 
-	flag.StringVar(&Path, "path", "./bloom_filter.rdb", "rdb file path")
+	flag.StringVar(&Path, "path", "./bloom_filter.rdb", "rdb or aof file path, may be gzip, zstd or lz4 compressed, appendonlydir or its manifest, - reads stdin, tcp://host:port or unix:///path read socket")
+	flag.StringVar(&Format, "format", "auto", "input format: rdb, resp (command log such as AOF or redis-cli --pipe file) or auto to detect RDB, RDB preamble AOF and AOF")
+	flag.BoolVar(&Verify, "verify", false, "read whole -path and check its structure and checksum before writing anything")
 	flag.BoolVar(&SkipRDB, "skip-rdb", false, "skip doing command")
 	flag.BoolVar(&Replace, "replace", true, "use restore command with replace")
+	flag.BoolVar(&Native, "native", false, "send native commands (SET, RPUSH, SADD, HSET, ZADD, XADD) instead of RESTORE")
 	flag.StringVar(&proxyHost, "proxy-host", "", "Proxy listening interface, default is on all interfaces")
 	flag.IntVar(&proxyPort, "proxy-port", 6380, "Proxy port for listening")
 	flag.StringVar(&proxyPassword, "proxy-password", "", "Proxy password")
+	flag.BoolVar(&Cluster, "cluster", false, "target is redis cluster, proxy-host:proxy-port is any of its nodes")
+	flag.IntVar(&Pipeline, "pipeline", 64, "max commands in flight per connection before waiting for replies")
+	flag.StringVar(&NutcrackerConf, "nutcracker-conf", "", "nutcracker.yml, keys are written directly to backend servers of twemproxy pool")
+	flag.StringVar(&NutcrackerPool, "nutcracker-pool", "", "pool of nutcracker.yml, may be omitted when there is single pool")
+	flag.StringVar(&OldNutcrackerConf, "old-nutcracker-conf", "", "nutcracker.yml of current layout, only keys changing owner are written")
+	flag.StringVar(&OldNutcrackerPool, "old-nutcracker-pool", "", "pool of old-nutcracker-conf, may be omitted when there is single pool")
+	flag.BoolVar(&DeleteMoved, "delete-moved", false, "delete moved keys from their old owners after migration")
+	flag.BoolVar(&PlanOnly, "plan", false, "print resharding plan without writing keys")
+	flag.StringVar(&Master, "master", "", "replicate from master host:port instead of reading -path")
+	flag.StringVar(&MasterPassword, "master-password", "", "master password")
+	flag.BoolVar(&Follow, "follow", false, "with -master keep forwarding master's write commands after RDB")
+	flag.DurationVar(&LagInterval, "lag-interval", 10*time.Second, "how often replication lag is reported with -follow, 0 disables it")
+	flag.IntVar(&Connections, "connections", 1, "number of connections commands are spread over, commands of one key use the same connection")
+	flag.StringVar(&ProxyAddrs, "proxy-addrs", "", "comma separated host:port of several proxy instances, connections are spread over them")
+	flag.Int64Var(&LargeKeySize, "large-key-size", 0, "commands of at least this many bytes use separate connections, 0 disables it")
+	flag.IntVar(&LargeConnections, "large-connections", 1, "number of connections for large commands")
+	flag.Int64Var(&MaxBytesInFlight, "max-bytes-in-flight", 256<<20, "max bytes of commands between parser and their replies, parser waits when exceeded, 0 is unlimited")
+	flag.DurationVar(&ProgressInterval, "progress-interval", 10*time.Second, "how often read offset of -path is reported, 0 disables it")
+	flag.StringVar(&DBMode, "db-mode", "ignore", "ignore: every key goes to db 0, select: SELECT db of key (or its -db-map target), prefix: keys of other dbs than 0 get -db-prefix")
+	flag.StringVar(&DBMap, "db-map", "", "source:target db pairs for -db-mode select, e.g. 3:0,4:1")
+	flag.StringVar(&DBPrefix, "db-prefix", "db%d:", "key prefix of -db-mode prefix, %d is source db")
+	flag.BoolVar(&DBCollisions, "db-collisions", false, "report keys of different dbs written to the same db and key, needs memory for every key")
+	flag.DurationVar(&MaxIdle, "max-idle", 0, "skip keys of RDB idle for longer than this, needs RDB saved with LRU maxmemory-policy, 0 disables it")
+	flag.IntVar(&MinFreq, "min-freq", 0, "skip keys of RDB with LFU counter below this, needs RDB saved with LFU maxmemory-policy, 0 disables it")
+	flag.BoolVar(&ProxyReplicas, "replication-proxy", false, "listen on proxy-host:proxy-port for replicas of -nutcracker-conf servers, each gets RDB and command stream of -master filtered to its keys")
+
+	// "info [flags] [path]" prints metadata of RDB without writing anything
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() > 0 {
+			Path = flag.Arg(0)
+		}
+		err := printInfo(Path, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "info: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 
+	if Verify && Master != "" {
+		fmt.Fprintf(os.Stderr, "verify: %s\n", ErrVerifyMaster)
+		os.Exit(1)
+	}
+
+	if ProxyReplicas {
+		err := serveReplicationProxy()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	ch1 := make(chan *RedisCommand, 10)
 	chs := []chan *RedisCommand{ch1}
 
-	var result string
-	if fileObj, err := os.Open(Path); err == nil {
-		defer fileObj.Close()
-		contents, _ := io.ReadAll(fileObj)
-		result = string(contents)
+	var input *Input
+	var manifest string
+	if Master == "" {
+		var err error
+		manifest, err = aofManifest(Path)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if Verify {
+		// budget isn't set yet, verification doesn't wait for replies
+		err := verifyInput(Path, manifest, Format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify: %s, nothing written\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "verify: %s is valid\n", Path)
+	}
+
+	sendBudget = NewByteBudget(MaxBytesInFlight)
+	// lag and ACKs of -follow count commands until their reply
+	if Master != "" {
+		appliedOffsets = NewOffsetTracker()
+	}
+
+	if Master == "" && manifest == "" {
+		var err error
+		input, err = openInput(Path)
+		if err != nil {
+			panic(err)
+		}
+		defer input.Close()
+
+		if ProgressInterval > 0 {
+			done := make(chan struct{})
+			defer close(done)
+			go input.reportProgress(ProgressInterval, done)
+		}
 	}
 
 	go func() {
-		err := ParseRDB(bufio.NewReader(bytes.NewBufferString(result)), chs[0], &counter)
+		var err error
+		if Master != "" {
+			err = replicate(chs[0])
+		} else if manifest != "" {
+			err = ParseAOFDir(manifest, chs[0], &counter, false)
+		} else {
+			err = parseInput(Format, input.Reader, chs[0], &counter, false)
+		}
 
 		if err != nil {
 
@@ -61,34 +184,53 @@ func main() {
 
 	}()
 
-	conn, err := getConn(fmt.Sprintf("%s:%d", proxyHost, proxyPort), proxyPassword)
+	target, err := getTarget()
 	if err != nil {
 		panic(err)
 	}
-	defer func(conn redis.Conn) {
-		err := conn.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(conn)
-
-	for cmd := range ch1 {
-		args := make([]interface{}, len(cmd.Command[1:]))
-
-		for i, arg := range cmd.Command[1:] {
-			args[i] = arg
-		}
+	// lag of -follow counts commands until their reply
+	if Master != "" {
+		target.Stats().onReply(trackApplied)
+	}
 
-		// todo pipeline send
-		err := conn.Send(cmd.Command[0], args...)
-		if err != nil {
-			panic(err)
-		}
-		err = conn.Flush()
-		if err != nil {
-			panic(err)
+	// pipelines are flushed periodically too, command stream of -follow may be slow
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+loop:
+	for {
+		select {
+		case cmd, ok := <-ch1:
+			if !ok {
+				break loop
+			}
+			appliedOffsets.Sent(cmd)
+			var err error
+			if cmd.AllNodes {
+				err = target.SendAll(cmd)
+			} else {
+				err = target.Send(cmd)
+			}
+			if err != nil {
+				panic(err)
+			}
+		case <-flush.C:
+			err := target.Flush()
+			if err != nil {
+				panic(err)
+			}
 		}
+	}
 
+	err = target.Close()
+	if err != nil {
+		panic(err)
 	}
 
+	// exit code tells whether every command succeeded
+	stats := target.Stats()
+	stats.Print(os.Stderr)
+	if stats.Failed() > 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,222 @@
+package main
+
+// RDB metadata: header version, aux fields, resizedb hints and what the file actually holds
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// characters of module type names, module id holds 9 of them in 6 bits each
+const moduleTypeCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+var (
+	// ErrNotRDB is returned by info for input which doesn't start with RDB
+	ErrNotRDB = errors.New("info: input isn't RDB or RDB preamble AOF")
+)
+
+// AuxField is key and value of aux opcode
+type AuxField struct {
+	Key   string
+	Value string
+}
+
+// DBInfo is size of database, as announced by resizedb and as counted
+type DBInfo struct {
+	// resizedb hints, zero when RDB has none
+	ResizeKeys    uint64
+	ResizeExpires uint64
+
+	Keys    int64
+	Expires int64
+}
+
+// RDBMetadata is everything parser learns about RDB besides keys
+type RDBMetadata struct {
+	Version int
+	// aux fields in order of file
+	Aux []AuxField
+
+	// known aux fields
+	RedisVer   string
+	RedisBits  int
+	CTime      time.Time
+	UsedMem    int64
+	ReplID     string
+	ReplOffset int64
+	AOFBase    bool
+
+	DBs map[int]*DBInfo
+	// number of keys by module type name
+	Modules map[string]int64
+	// names of function libraries and number of lua scripts
+	Functions []string
+	Scripts   int
+	// slot info records of cluster node and keys found outside their announced slot
+	Slots      int
+	SlotErrors int64
+}
+
+func newRDBMetadata() *RDBMetadata {
+	return &RDBMetadata{DBs: map[int]*DBInfo{}, Modules: map[string]int64{}}
+}
+
+// ParseRDBMetadata parses RDB like ParseRDB and returns its metadata, nothing is sent when output is nil
+func ParseRDBMetadata(reader *bufio.Reader, output chan *RedisCommand, counter *uint64) (*RDBMetadata, error) {
+	parser := &Parser{
+		reader:  reader,
+		output:  output,
+		counter: counter,
+	}
+
+	err := parser.run()
+	return parser.metadata, err
+}
+
+// setAux remembers aux field, known fields are parsed too
+func (m *RDBMetadata) setAux(key string, value string) {
+	m.Aux = append(m.Aux, AuxField{Key: key, Value: value})
+
+	// malformed values are kept in Aux only
+	switch key {
+	case "redis-ver":
+		m.RedisVer = value
+	case "redis-bits":
+		m.RedisBits, _ = strconv.Atoi(value)
+	case "ctime":
+		if ctime, err := strconv.ParseInt(value, 10, 64); err == nil {
+			m.CTime = time.Unix(ctime, 0)
+		}
+	case "used-mem":
+		m.UsedMem, _ = strconv.ParseInt(value, 10, 64)
+	case "repl-id":
+		m.ReplID = value
+	case "repl-offset":
+		m.ReplOffset, _ = strconv.ParseInt(value, 10, 64)
+	case "aof-base":
+		m.AOFBase = value == "1"
+	case "lua":
+		m.Scripts++
+	}
+}
+
+// db returns info of database n
+func (m *RDBMetadata) db(n int) *DBInfo {
+	info := m.DBs[n]
+	if info == nil {
+		info = &DBInfo{}
+		m.DBs[n] = info
+	}
+	return info
+}
+
+// Keys returns number of keys in all databases
+func (m *RDBMetadata) Keys() int64 {
+	var keys int64
+	for _, info := range m.DBs {
+		keys += info.Keys
+	}
+	return keys
+}
+
+// moduleTypeName decodes module id: 9 characters of type name followed by 10 bits of encoding version
+func moduleTypeName(id uint64) (string, int) {
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = moduleTypeCharset[(id>>(64-6*(i+1)))&63]
+	}
+	return string(name), int(id & 1023)
+}
+
+// Print writes metadata as aligned table
+func (m *RDBMetadata) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-20s %d\n", "version", m.Version)
+	for _, aux := range m.Aux {
+		value := aux.Value
+		if aux.Key == "ctime" && !m.CTime.IsZero() {
+			value = fmt.Sprintf("%s (%s)", aux.Value, m.CTime.UTC().Format(time.RFC3339))
+		} else if aux.Key == "lua" {
+			value = fmt.Sprintf("script of %d bytes", len(aux.Value))
+		}
+		fmt.Fprintf(w, "%-20s %s\n", aux.Key, value)
+	}
+
+	dbs := make([]int, 0, len(m.DBs))
+	for n := range m.DBs {
+		dbs = append(dbs, n)
+	}
+	sort.Ints(dbs)
+
+	fmt.Fprintf(w, "\n%-8s %12s %12s %16s %16s\n", "db", "keys", "expires", "resizedb keys", "resizedb expires")
+	for _, n := range dbs {
+		info := m.DBs[n]
+		fmt.Fprintf(w, "%-8d %12d %12d %16d %16d\n", n, info.Keys, info.Expires, info.ResizeKeys, info.ResizeExpires)
+	}
+	fmt.Fprintf(w, "%-8s %12d\n", "total", m.Keys())
+
+	if m.Slots > 0 {
+		fmt.Fprintf(w, "\n%-20s %d\n", "cluster slots", m.Slots)
+		fmt.Fprintf(w, "%-20s %d\n", "keys outside slot", m.SlotErrors)
+	}
+
+	if len(m.Functions) > 0 {
+		fmt.Fprintf(w, "\n%-20s %s\n", "function libraries", strings.Join(m.Functions, " "))
+	}
+
+	if len(m.Modules) == 0 {
+		return
+	}
+	modules := make([]string, 0, len(m.Modules))
+	for name := range m.Modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+
+	fmt.Fprintf(w, "\n%-20s %12s\n", "module type", "keys")
+	for _, name := range modules {
+		fmt.Fprintf(w, "%-20s %12d\n", name, m.Modules[name])
+	}
+}
+
+// printInfo prints metadata of RDB at path, base file is used for appendonlydir
+func printInfo(path string, w io.Writer) error {
+	manifest, err := aofManifest(path)
+	if err != nil {
+		return err
+	}
+	if manifest != "" {
+		files, err := loadAOFManifest(manifest)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return ErrNotRDB
+		}
+		path = files[0]
+	}
+
+	input, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	signature, err := input.Peek(len(rdbSignature))
+	if err != nil || !bytes.Equal(signature, rdbSignature) {
+		return ErrNotRDB
+	}
+
+	metadata, err := ParseRDBMetadata(input.Reader, nil, nil)
+	if err != nil {
+		return err
+	}
+	metadata.Print(w)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRDBMetadata(t *testing.T) {
+	file, err := os.Open("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	metadata, err := ParseRDBMetadata(bufio.NewReader(file), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Version != 9 || metadata.RedisVer != "6.0.6" || metadata.RedisBits != 64 ||
+		metadata.UsedMem != 1167584 || metadata.CTime.Unix() != 1644136130 {
+		t.Errorf("metadata %+v", metadata)
+	}
+	if len(metadata.Aux) != 5 || metadata.Aux[0] != (AuxField{"redis-ver", "6.0.6"}) {
+		t.Errorf("aux fields %v", metadata.Aux)
+	}
+	if db := metadata.DBs[0]; db == nil || *db != (DBInfo{ResizeKeys: 7, ResizeExpires: 1, Keys: 7, Expires: 1}) {
+		t.Errorf("db 0 %+v", db)
+	}
+}
+
+func TestModuleMetadata(t *testing.T) {
+	name, encver := moduleTypeName(3465209449566631940)
+	if name != "MBbloom--" || encver != 4 {
+		t.Errorf("module type %s version %d", name, encver)
+	}
+
+	var out bytes.Buffer
+	if err := printInfo("./cases/bloom_filter.rdb", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "MBbloom-- v4") || !strings.Contains(out.String(), "redis-ver") {
+		t.Errorf("info:\n%s", out.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, aofCommands([]string{"SET", "a", "b"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := printInfo(path, &out); err != ErrNotRDB {
+		t.Errorf("info of AOF: %v", err)
+	}
+}
+
+func TestMetadataModules(t *testing.T) {
+	file, err := os.Open("./cases/bloom_filter.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	metadata, err := ParseRDBMetadata(bufio.NewReader(file), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.Modules, map[string]int64{"MBbloom-- v4": metadata.Keys()}) {
+		t.Errorf("modules %v of %d keys", metadata.Modules, metadata.Keys())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+// Module types: values of RDB_TYPE_MODULE_2 are copied by handler registered for module type name and encoding version,
+// values of other modules are copied opcode by opcode
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AnyModuleVersion registers handler for every encoding version of module type
+const AnyModuleVersion = -1
+
+var (
+	// ErrUnknownModule is returned when value of module type without registered handler can't be copied
+	ErrUnknownModule = errors.New("rdb: no handler for module type")
+	// ErrModuleOpcode is returned for module value with byte which isn't module opcode
+	ErrModuleOpcode = errors.New("rdb: unknown module opcode")
+
+	moduleHandlersLock sync.RWMutex
+	moduleHandlers     = map[moduleVersion]ModuleHandler{
+		{"MBbloom--", 4}: ModuleHandlerFunc(copyBloomFilter),
+		{"MBbloomCF", 4}: ModuleHandlerFunc(copyCuckooFilter),
+		{"TopK-TYPE", 0}: ModuleHandlerFunc(copyTopk),
+		{"TDIS-TYPE", 0}: ModuleHandlerFunc(copyTDigest),
+		{"CMSk-TYPE", 0}: ModuleHandlerFunc(copyCMS),
+	}
+)
+
+// ModuleHandler copies value of module type, everything read by parser with save set goes to RESTORE payload
+type ModuleHandler interface {
+	// Copy reads value following module id up to RdbModuleOpcodeEOF, which is read by parser
+	Copy(parser *Parser) error
+}
+
+// ModuleHandlerFunc is function used as ModuleHandler
+type ModuleHandlerFunc func(parser *Parser) error
+
+// Copy calls f
+func (f ModuleHandlerFunc) Copy(parser *Parser) error {
+	return f(parser)
+}
+
+type moduleVersion struct {
+	name   string
+	encver int
+}
+
+// RegisterModuleHandler sets handler of 9 character module type name and encoding version, AnyModuleVersion matches
+// versions without their own handler, registering again replaces handler; call it from init() of file adding handler
+func RegisterModuleHandler(name string, encver int, handler ModuleHandler) {
+	moduleHandlersLock.Lock()
+	defer moduleHandlersLock.Unlock()
+
+	moduleHandlers[moduleVersion{name, encver}] = handler
+}
+
+// handler of module type and version, nil when there is none
+func moduleHandler(name string, encver int) ModuleHandler {
+	moduleHandlersLock.RLock()
+	defer moduleHandlersLock.RUnlock()
+
+	if handler, ok := moduleHandlers[moduleVersion{name, encver}]; ok {
+		return handler
+	}
+	return moduleHandlers[moduleVersion{name, AnyModuleVersion}]
+}
+
+// copyModuleOpcodes copies module value as sequence of typed values (SINT, UINT, FLOAT, DOUBLE, STRING) up to
+// RdbModuleOpcodeEOF, module API writes every value of RDB_TYPE_MODULE_2 this way
+func copyModuleOpcodes(parser *Parser) error {
+	for {
+		next, err := parser.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+		if next[0] == RdbModuleOpcodeEOF {
+			return nil
+		}
+
+		opcode, _, err := parser.readLength(true)
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case RdbModuleOpcodeSInt, RdbModuleOpcodeUInt:
+			_, _, err = parser.readLength(true)
+		case RdbModuleOpcodeFloat:
+			err = parser.copyRaw(4)
+		case RdbModuleOpcodeDouble:
+			err = parser.copyRaw(8)
+		case RdbModuleOpcodeString:
+			err = parser.copyString(true)
+		default:
+			return fmt.Errorf("%w %d", ErrModuleOpcode, opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
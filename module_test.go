@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// module id of type name and encoding version
+func moduleTypeID(name string, encver int) uint64 {
+	var id uint64
+	for i := 0; i < 9; i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleTypeCharset, name[i]))
+	}
+	return id<<10 | uint64(encver)
+}
+
+// module value of opcodes, unsigned 42 by default
+func moduleRDB(name string, encver int, opcodes ...byte) []byte {
+	if opcodes == nil {
+		opcodes = []byte{RdbModuleOpcodeUInt, 42}
+	}
+	value := append([]byte{rdbOpModule2}, rdbString("m")...)
+	value = append(value, encodeLength(moduleTypeID(name, encver))...)
+	value = append(append(value, opcodes...), RdbModuleOpcodeEOF)
+	return buildRDB(9, value)
+}
+
+func TestModuleTypeName(t *testing.T) {
+	name, encver := moduleTypeName(moduleTypeID("MBbloom--", 4))
+	if name != "MBbloom--" || encver != 4 || moduleTypeID(name, encver) != 3465209449566631940 {
+		t.Errorf("module %s v%d", name, encver)
+	}
+}
+
+func TestModuleHandler(t *testing.T) {
+	var value uint64
+	RegisterModuleHandler("TestMod-A", AnyModuleVersion, ModuleHandlerFunc(func(parser *Parser) error {
+		var err error
+		value, err = parser.readUnsigned(true)
+		return err
+	}))
+	defer delete(moduleHandlers, moduleVersion{"TestMod-A", AnyModuleVersion})
+
+	cmds := parseRDBCommands(t, moduleRDB("TestMod-A", 3))
+	if len(cmds) != 1 || value != 42 {
+		t.Fatalf("%d commands, value %d", len(cmds), value)
+	}
+	payload := []byte(cmds[0].Command[3])
+	if !bytes.HasSuffix(payload[:len(payload)-10], []byte{RdbModuleOpcodeUInt, 42, RdbModuleOpcodeEOF}) {
+		t.Errorf("payload %q", payload)
+	}
+}
+
+func TestUnknownModule(t *testing.T) {
+	opcodes := []byte{RdbModuleOpcodeSInt, 1, RdbModuleOpcodeUInt, 0x40, 0xff}
+	opcodes = append(opcodes, RdbModuleOpcodeFloat, 0, 0, 0x80, 0x3f)
+	opcodes = append(opcodes, RdbModuleOpcodeDouble, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f)
+	opcodes = append(append(opcodes, RdbModuleOpcodeString), rdbString("state")...)
+
+	cmds := parseRDBCommands(t, moduleRDB("TestMod-B", 2, opcodes...))
+	if len(cmds) != 1 {
+		t.Fatalf("%d commands", len(cmds))
+	}
+	payload := []byte(cmds[0].Command[3])
+	if !bytes.HasSuffix(payload[:len(payload)-10], append(opcodes, RdbModuleOpcodeEOF)) {
+		t.Errorf("payload %q", payload)
+	}
+
+	// malformed value of module without handler names module
+	err := ParseRDB(bufio.NewReader(bytes.NewReader(moduleRDB("TestMod-B", 2, 9))), nil, nil)
+	if !errors.Is(err, ErrUnknownModule) || !strings.Contains(err.Error(), "TestMod-B v2") {
+		t.Errorf("error %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+// Native write commands (SET, RPUSH, SADD, HSET, ZADD, XADD) built from decoded objects, alternative to RESTORE
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// max number of elements sent by single RPUSH/SADD/HSET/ZADD
+	nativeBatchSize = 512
+
+	// consumer group used to create empty streams
+	streamPlaceholderGroup = "redis-proxy-resharding"
+)
+
+var (
+	// ErrNoNativeEncoding is returned for values which can't be expressed with plain commands (modules)
+	ErrNoNativeEncoding = errors.New("rdb: value has no native command encoding")
+)
+
+// objectCommands builds plain write commands restoring obj, without Replace elements are added to existing key
+func objectCommands(obj RedisObject) ([]*RedisCommand, error) {
+	key := obj.GetKey()
+	var cmds []*RedisCommand
+
+	switch obj := obj.(type) {
+	case *StringObject:
+		cmds = []*RedisCommand{{Command: []string{"SET", key, obj.Value}}}
+	case *ListObject:
+		cmds = batchCommands("RPUSH", key, obj.Values, 1)
+	case *SetObject:
+		cmds = batchCommands("SADD", key, obj.Members, 1)
+	case *HashObject:
+		args := make([]string, 0, len(obj.Fields)*2)
+		for _, field := range obj.Fields {
+			args = append(args, field.Field, field.Value)
+		}
+		cmds = batchCommands("HSET", key, args, 2)
+		cmds = append(cmds, fieldExpireCommands(key, obj.Fields)...)
+	case *ZSetObject:
+		args := make([]string, 0, len(obj.Entries)*2)
+		for _, entry := range obj.Entries {
+			args = append(args, formatScore(entry.Score), entry.Member)
+		}
+		cmds = batchCommands("ZADD", key, args, 2)
+	case *StreamObject:
+		cmds = streamCommands(obj)
+	default:
+		return nil, ErrNoNativeEncoding
+	}
+
+	if Replace && obj.GetType() != StringType {
+		cmds = append([]*RedisCommand{{Command: []string{"DEL", key}}}, cmds...)
+	}
+	if obj.GetExpireAt() > 0 {
+		cmds = append(cmds, &RedisCommand{Command: []string{"PEXPIREAT", key, fmt.Sprint(obj.GetExpireAt())}})
+	}
+
+	return cmds, nil
+}
+
+// split args of multi element command into commands of at most nativeBatchSize elements
+func batchCommands(name string, key string, args []string, step int) []*RedisCommand {
+	var cmds []*RedisCommand
+
+	for len(args) > 0 {
+		n := nativeBatchSize * step
+		if n > len(args) {
+			n = len(args)
+		}
+
+		command := make([]string, 0, n+2)
+		command = append(command, name, key)
+		command = append(command, args[:n]...)
+		cmds = append(cmds, &RedisCommand{Command: command})
+
+		args = args[n:]
+	}
+
+	return cmds
+}
+
+// build HPEXPIREAT commands of hash fields with TTL, fields expiring at the same time share command
+func fieldExpireCommands(key string, fields []HashField) []*RedisCommand {
+	var times []uint64
+	byTime := map[uint64][]string{}
+	for _, field := range fields {
+		if field.ExpireAt == 0 {
+			continue
+		}
+		if _, ok := byTime[field.ExpireAt]; !ok {
+			times = append(times, field.ExpireAt)
+		}
+		byTime[field.ExpireAt] = append(byTime[field.ExpireAt], field.Field)
+	}
+
+	var cmds []*RedisCommand
+	for _, at := range times {
+		names := byTime[at]
+		for len(names) > 0 {
+			n := nativeBatchSize
+			if n > len(names) {
+				n = len(names)
+			}
+
+			command := []string{"HPEXPIREAT", key, fmt.Sprint(at), "FIELDS", fmt.Sprint(n)}
+			cmds = append(cmds, &RedisCommand{Command: append(command, names[:n]...)})
+			names = names[n:]
+		}
+	}
+	return cmds
+}
+
+// build XADD, XSETID, XGROUP and XCLAIM commands restoring stream
+func streamCommands(obj *StreamObject) []*RedisCommand {
+	key := obj.Key
+	var cmds []*RedisCommand
+
+	for _, entry := range obj.Entries {
+		command := []string{"XADD", key, entry.ID.String()}
+		cmds = append(cmds, &RedisCommand{Command: append(command, entry.Fields...)})
+	}
+
+	if len(cmds) == 0 {
+		// XSETID and XGROUP need existing stream
+		cmds = append(cmds,
+			&RedisCommand{Command: []string{"XGROUP", "CREATE", key, streamPlaceholderGroup, "0", "MKSTREAM"}},
+			&RedisCommand{Command: []string{"XGROUP", "DESTROY", key, streamPlaceholderGroup}},
+		)
+	}
+
+	setID := []string{"XSETID", key, obj.LastID.String()}
+	if obj.Version > 1 {
+		setID = append(setID, "ENTRIESADDED", fmt.Sprint(obj.EntriesAdded), "MAXDELETEDID", obj.MaxDeletedID.String())
+	}
+	cmds = append(cmds, &RedisCommand{Command: setID})
+
+	for _, group := range obj.Groups {
+		create := []string{"XGROUP", "CREATE", key, group.Name, group.LastID.String()}
+		if group.EntriesRead >= 0 {
+			create = append(create, "ENTRIESREAD", fmt.Sprint(group.EntriesRead))
+		}
+		cmds = append(cmds, &RedisCommand{Command: create})
+
+		pending := make(map[StreamID]*StreamPendingEntry, len(group.Pending))
+		for _, entry := range group.Pending {
+			pending[entry.ID] = entry
+		}
+
+		for _, consumer := range group.Consumers {
+			cmds = append(cmds, &RedisCommand{Command: []string{"XGROUP", "CREATECONSUMER", key, group.Name, consumer.Name}})
+
+			for _, id := range consumer.Pending {
+				entry, ok := pending[id]
+				if !ok {
+					entry = &StreamPendingEntry{ID: id}
+				}
+				cmds = append(cmds, &RedisCommand{Command: []string{
+					"XCLAIM", key, group.Name, consumer.Name, "0", id.String(),
+					"TIME", fmt.Sprint(entry.DeliveryTime),
+					"RETRYCOUNT", fmt.Sprint(entry.DeliveryCount),
+					"FORCE", "JUSTID",
+				}})
+			}
+		}
+	}
+
+	return cmds
+}
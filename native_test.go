@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func nativeTest(t *testing.T, path string, aofPath string) {
+	defer func(native, replace bool) { Native, Replace = native, replace }(Native, Replace)
+	Native, Replace = true, false
+
+	fileObj, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileObj.Close()
+
+	ch1 := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseRDB(bufio.NewReader(fileObj), ch1, nil)
+		close(ch1)
+	}()
+
+	var buf bytes.Buffer
+	for cmd := range ch1 {
+		fmt.Fprintf(&buf, "*%d\r\n", len(cmd.Command))
+		for _, arg := range cmd.Command {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := os.ReadFile(aofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("native commands of %s don't match %s:\n%q", path, aofPath, buf.String())
+	}
+}
+
+func Test_native_memory(t *testing.T) {
+	// AOF of redis with HSET in place of deprecated HMSET
+	nativeTest(t, "./cases/memory.rdb", "./cases/memory_native.aof")
+}
+
+// without -replace values are written into existing keys, with it other types than string are deleted first
+func TestNativeReplace(t *testing.T) {
+	defer func(replace bool) { Replace = replace }(Replace)
+
+	str := &StringObject{BaseObject: &BaseObject{Key: "s", Type: StringType}, Value: "v"}
+	list := &ListObject{BaseObject: &BaseObject{Key: "l", Type: ListType}, Values: []string{"a", "b"}}
+	for _, c := range []struct {
+		replace  bool
+		obj      RedisObject
+		expected [][]string
+	}{
+		{false, str, [][]string{{"SET", "s", "v"}}},
+		{true, str, [][]string{{"SET", "s", "v"}}},
+		{false, list, [][]string{{"RPUSH", "l", "a", "b"}}},
+		{true, list, [][]string{{"DEL", "l"}, {"RPUSH", "l", "a", "b"}}},
+	} {
+		Replace = c.replace
+		cmds, err := objectCommands(c.obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]string
+		for _, cmd := range cmds {
+			got = append(got, cmd.Command)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s with replace %v: %q", c.obj.GetKey(), c.replace, got)
+		}
+	}
+}
@@ -0,0 +1,789 @@
+package main
+
+// Typed object model of RDB values, decoded from the same payload that is sent with RESTORE
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	StringType = "string"
+	ListType   = "list"
+	SetType    = "set"
+	HashType   = "hash"
+	ZSetType   = "zset"
+	StreamType = "stream"
+	ModuleType = "module"
+
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+var (
+	// ErrUnknownValueType is returned when payload holds unknown value type
+	ErrUnknownValueType = errors.New("rdb: unknown value type")
+)
+
+// RedisObject is decoded value of single key
+type RedisObject interface {
+	GetDB() int
+	GetKey() string
+	GetType() string
+	GetEncoding() string
+	// GetExpireAt returns expiration as unix time in milliseconds, 0 if key doesn't expire
+	GetExpireAt() uint64
+}
+
+// BaseObject holds fields shared by all objects
+type BaseObject struct {
+	DB       int
+	Key      string
+	Type     string
+	Encoding string
+	ExpireAt uint64
+}
+
+func (o *BaseObject) GetDB() int          { return o.DB }
+func (o *BaseObject) GetKey() string      { return o.Key }
+func (o *BaseObject) GetType() string     { return o.Type }
+func (o *BaseObject) GetEncoding() string { return o.Encoding }
+func (o *BaseObject) GetExpireAt() uint64 { return o.ExpireAt }
+
+// StringObject is string value
+type StringObject struct {
+	*BaseObject
+	Value string
+}
+
+// ListObject is list value, elements in list order
+type ListObject struct {
+	*BaseObject
+	Values []string
+}
+
+// SetObject is set value
+type SetObject struct {
+	*BaseObject
+	Members []string
+}
+
+// HashField is single field of hash, ExpireAt is unix time in milliseconds, 0 if field doesn't expire
+type HashField struct {
+	Field    string
+	Value    string
+	ExpireAt uint64
+}
+
+// HashObject is hash value, fields in stored order
+type HashObject struct {
+	*BaseObject
+	Fields []HashField
+}
+
+// ZSetEntry is member of sorted set with its score
+type ZSetEntry struct {
+	Member string
+	Score  float64
+}
+
+// ZSetObject is sorted set value
+type ZSetObject struct {
+	*BaseObject
+	Entries []ZSetEntry
+}
+
+// StreamID is ID of stream entry
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// StreamEntry is single stream entry, fields as flat field, value list
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// StreamPendingEntry is entry of consumer group PEL
+type StreamPendingEntry struct {
+	ID            StreamID
+	DeliveryTime  uint64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is consumer of consumer group with IDs it owns
+type StreamConsumer struct {
+	Name       string
+	SeenTime   uint64
+	ActiveTime uint64
+	Pending    []StreamID
+}
+
+// StreamGroup is consumer group of stream, EntriesRead is -1 when unknown
+type StreamGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+	Pending     []*StreamPendingEntry
+	Consumers   []*StreamConsumer
+}
+
+// StreamObject is stream value, Version is stream listpacks type version (1, 2 or 3)
+type StreamObject struct {
+	*BaseObject
+	Version      int
+	Length       uint64
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Entries      []*StreamEntry
+	Groups       []*StreamGroup
+}
+
+// ModuleObject is module value, kept as DUMP payload
+type ModuleObject struct {
+	*BaseObject
+	Payload []byte
+}
+
+// build parser reading DUMP-like payload, type byte excluded
+func newPayloadParser(payload []byte) *Parser {
+	return &Parser{reader: bufio.NewReader(bytes.NewReader(payload))}
+}
+
+// DecodeObject decodes payload (type byte followed by value) of key
+func DecodeObject(key string, payload []byte) (RedisObject, error) {
+	return decodeObject(&BaseObject{Key: key}, payload)
+}
+
+func decodeObject(base *BaseObject, payload []byte) (RedisObject, error) {
+	if len(payload) == 0 {
+		return nil, ErrCorruptEncoding
+	}
+
+	op := payload[0]
+	parser := newPayloadParser(payload[1:])
+	parser.currentOp = op
+
+	var err error
+
+	switch op {
+	case rdbOpString:
+		obj := &StringObject{BaseObject: base}
+		base.Type, base.Encoding = StringType, "string"
+		obj.Value, err = parser.readString(false)
+		return obj, err
+	case rdbOpList, rdbOpZiplist, rdbOpListQuicklist, rdbOpListQuicklist2:
+		obj := &ListObject{BaseObject: base}
+		base.Type = ListType
+		switch op {
+		case rdbOpList:
+			base.Encoding = "list"
+			obj.Values, err = parser.readStringList(1)
+		case rdbOpZiplist:
+			base.Encoding = "ziplist"
+			obj.Values, err = parser.readEncoded(decodeZiplist)
+		case rdbOpListQuicklist:
+			base.Encoding = "quicklist"
+			obj.Values, err = parser.readQuicklist()
+		default:
+			base.Encoding = "quicklist2"
+			obj.Values, err = parser.readQuicklist()
+		}
+		return obj, err
+	case rdbOpSet, rdbOpIntset, rdbOpSetListpack:
+		obj := &SetObject{BaseObject: base}
+		base.Type = SetType
+		switch op {
+		case rdbOpSet:
+			base.Encoding = "set"
+			obj.Members, err = parser.readStringList(1)
+		case rdbOpIntset:
+			base.Encoding = "intset"
+			obj.Members, err = parser.readEncoded(decodeIntset)
+		default:
+			base.Encoding = "listpack"
+			obj.Members, err = parser.readEncoded(decodeListpack)
+		}
+		return obj, err
+	case rdbOpHash, rdbOpZipmap, rdbOpHashmap, rdbOpHashListpack:
+		var fields []string
+		base.Type = HashType
+		switch op {
+		case rdbOpHash:
+			base.Encoding = "hash"
+			fields, err = parser.readStringList(2)
+		case rdbOpZipmap:
+			base.Encoding = "zipmap"
+			fields, err = parser.readEncoded(decodeZipmap)
+		case rdbOpHashmap:
+			base.Encoding = "ziplist"
+			fields, err = parser.readEncoded(decodeZiplist)
+		default:
+			base.Encoding = "listpack"
+			fields, err = parser.readEncoded(decodeListpack)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &HashObject{BaseObject: base, Fields: hashFields(fields)}, nil
+	case rdbOpHashMetadata, rdbOpHashMetadataPreGA:
+		base.Type, base.Encoding = HashType, "hashtable"
+		obj := &HashObject{BaseObject: base}
+		obj.Fields, err = parser.readHashMetadata()
+		return obj, err
+	case rdbOpHashListpackEx, rdbOpHashListpackExPreGA:
+		base.Type, base.Encoding = HashType, "listpackex"
+		obj := &HashObject{BaseObject: base}
+		obj.Fields, err = parser.readHashListpackEx()
+		return obj, err
+	case rdbOpZset, rdbOpZset2, rdbOpSortedSet, rdbOpZsetListpack:
+		var entries []string
+		base.Type = ZSetType
+		switch op {
+		case rdbOpZset:
+			base.Encoding = "zset"
+			entries, err = parser.readZsetEntries()
+		case rdbOpZset2:
+			base.Encoding = "zset2"
+			entries, err = parser.readZsetEntries()
+		case rdbOpSortedSet:
+			base.Encoding = "ziplist"
+			entries, err = parser.readEncoded(decodeZiplist)
+		default:
+			base.Encoding = "listpack"
+			entries, err = parser.readEncoded(decodeListpack)
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj := &ZSetObject{BaseObject: base}
+		obj.Entries, err = zsetEntries(entries)
+		return obj, err
+	case rdbOpStreamListpacks, rdbOpStreamListpacks2, rdbOpStreamListpacks3:
+		base.Type, base.Encoding = StreamType, "listpack"
+		obj, err := parser.readStream(base)
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case rdbOpModule2:
+		base.Type, base.Encoding = ModuleType, "module"
+		return &ModuleObject{BaseObject: base, Payload: payload}, nil
+	}
+
+	return nil, ErrUnknownValueType
+}
+
+// pair flat field, value list
+func hashFields(fields []string) []HashField {
+	result := make([]HashField, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		result = append(result, HashField{Field: fields[i], Value: fields[i+1]})
+	}
+	return result
+}
+
+// read fields of hash with field TTLs, GA version stores TTLs relative to min expiration
+func (parser *Parser) readHashMetadata() ([]HashField, error) {
+	var minExpire uint64
+	if parser.currentOp == rdbOpHashMetadata {
+		data, err := parser.safeRead(8)
+		if err != nil {
+			return nil, err
+		}
+		minExpire = binary.LittleEndian.Uint64(data)
+	}
+
+	length, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]HashField, 0, length)
+	for i := uint64(0); i < length; i++ {
+		ttl, _, err := parser.readLength(false)
+		if err != nil {
+			return nil, err
+		}
+		if ttl != 0 && parser.currentOp == rdbOpHashMetadata {
+			ttl += minExpire - 1
+		}
+
+		field, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+		value, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, HashField{Field: field, Value: value, ExpireAt: ttl})
+	}
+	return result, nil
+}
+
+// read listpack of field, value, ttl triplets, ttl is absolute and 0 when field doesn't expire
+func (parser *Parser) readHashListpackEx() ([]HashField, error) {
+	if parser.currentOp == rdbOpHashListpackEx {
+		// min expiration, every field has its own
+		_, err := parser.safeRead(8)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := parser.readEncoded(decodeListpack)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%3 != 0 {
+		return nil, ErrCorruptEncoding
+	}
+
+	result := make([]HashField, 0, len(entries)/3)
+	for i := 0; i < len(entries); i += 3 {
+		ttl, err := strconv.ParseUint(entries[i+2], 10, 64)
+		if err != nil {
+			return nil, ErrCorruptEncoding
+		}
+		result = append(result, HashField{Field: entries[i], Value: entries[i+1], ExpireAt: ttl})
+	}
+	return result, nil
+}
+
+// pair flat member, score list
+func zsetEntries(entries []string) ([]ZSetEntry, error) {
+	result := make([]ZSetEntry, 0, len(entries)/2)
+	for i := 0; i+1 < len(entries); i += 2 {
+		score, err := strconv.ParseFloat(entries[i+1], 64)
+		if err != nil {
+			return nil, ErrCorruptEncoding
+		}
+		result = append(result, ZSetEntry{Member: entries[i], Score: score})
+	}
+	return result, nil
+}
+
+// read length prefixed list of strings, length counts groups of width strings
+func (parser *Parser) readStringList(width int) ([]string, error) {
+	length, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, length*uint64(width))
+	for i := uint64(0); i < length*uint64(width); i++ {
+		value, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// read zset as flat member, score list
+func (parser *Parser) readZsetEntries() ([]string, error) {
+	length, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, length*2)
+	for i := uint64(0); i < length; i++ {
+		member, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+
+		score, err := parser.readScore()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, member, score)
+	}
+	return result, nil
+}
+
+// read zset score, binary double for RDB_TYPE_ZSET_2, string encoded otherwise
+func (parser *Parser) readScore() (string, error) {
+	if parser.currentOp == rdbOpZset2 {
+		data, err := parser.safeRead(8)
+		if err != nil {
+			return "", err
+		}
+		return formatScore(math.Float64frombits(binary.LittleEndian.Uint64(data))), nil
+	}
+
+	dlen, err := parser.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	switch dlen {
+	case 0xFD:
+		return "nan", nil
+	case 0xFE:
+		return "+inf", nil
+	case 0xFF:
+		return "-inf", nil
+	}
+
+	data, err := parser.safeRead(uint64(dlen))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// read string holding compact encoding and decode it
+func (parser *Parser) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	data, err := parser.readString(false)
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(data))
+}
+
+// read quicklist, ziplist nodes for RDB_TYPE_LIST_QUICKLIST, plain or listpack nodes for RDB_TYPE_LIST_QUICKLIST_2
+func (parser *Parser) readQuicklist() ([]string, error) {
+	nodes, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if parser.currentOp == rdbOpListQuicklist2 {
+			container, _, err = parser.readLength(false)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+
+		var values []string
+		switch {
+		case container == quicklistNodePlain:
+			values = []string{data}
+		case parser.currentOp == rdbOpListQuicklist2:
+			values, err = decodeListpack([]byte(data))
+		default:
+			values, err = decodeZiplist([]byte(data))
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, values...)
+	}
+	return result, nil
+}
+
+// read stream with its metadata and consumer groups
+func (parser *Parser) readStream(base *BaseObject) (*StreamObject, error) {
+	obj := &StreamObject{BaseObject: base, Version: 1}
+	switch parser.currentOp {
+	case rdbOpStreamListpacks2:
+		obj.Version = 2
+	case rdbOpStreamListpacks3:
+		obj.Version = 3
+	}
+
+	listpacks, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < listpacks; i++ {
+		master, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+		if len(master) != streamIDSize {
+			return nil, ErrCorruptEncoding
+		}
+
+		data, err := parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+		values, err := decodeListpack([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := streamEntries(rawStreamID([]byte(master)), values)
+		if err != nil {
+			return nil, err
+		}
+		obj.Entries = append(obj.Entries, entries...)
+	}
+
+	obj.Length, _, err = parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+	obj.LastID, err = parser.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.Version > 1 {
+		obj.FirstID, err = parser.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		obj.MaxDeletedID, err = parser.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		obj.EntriesAdded, _, err = parser.readLength(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < groups; i++ {
+		group, err := parser.readStreamGroup(obj.Version)
+		if err != nil {
+			return nil, err
+		}
+		obj.Groups = append(obj.Groups, group)
+	}
+
+	return obj, nil
+}
+
+// decode entries of single stream listpack, deleted entries are skipped
+func streamEntries(master StreamID, values []string) ([]*StreamEntry, error) {
+	nums := func(values ...string) ([]int64, error) {
+		result := make([]int64, len(values))
+		for i, value := range values {
+			num, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, ErrCorruptEncoding
+			}
+			result[i] = num
+		}
+		return result, nil
+	}
+
+	// master entry: count, deleted, number of fields, fields, terminator
+	if len(values) < 3 {
+		return nil, ErrCorruptEncoding
+	}
+	header, err := nums(values[2])
+	if err != nil {
+		return nil, err
+	}
+	numFields := int(header[0])
+	if len(values) < 4+numFields {
+		return nil, ErrCorruptEncoding
+	}
+	masterFields := values[3 : 3+numFields]
+	pos := 4 + numFields
+
+	var entries []*StreamEntry
+	for pos < len(values) {
+		// flags, ms diff, seq diff
+		if pos+3 > len(values) {
+			return nil, ErrCorruptEncoding
+		}
+		id, err := nums(values[pos : pos+3]...)
+		if err != nil {
+			return nil, err
+		}
+		pos += 3
+		flags := id[0]
+
+		var fields []string
+		if flags&streamItemFlagSameFields != 0 {
+			if pos+numFields > len(values) {
+				return nil, ErrCorruptEncoding
+			}
+			for i, field := range masterFields {
+				fields = append(fields, field, values[pos+i])
+			}
+			pos += numFields
+		} else {
+			if pos >= len(values) {
+				return nil, ErrCorruptEncoding
+			}
+			count, err := nums(values[pos])
+			if err != nil {
+				return nil, err
+			}
+			pos++
+			if pos+int(count[0])*2 > len(values) {
+				return nil, ErrCorruptEncoding
+			}
+			fields = values[pos : pos+int(count[0])*2]
+			pos += int(count[0]) * 2
+		}
+
+		// lp-count
+		pos++
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+
+		entries = append(entries, &StreamEntry{
+			ID:     StreamID{Ms: master.Ms + uint64(id[1]), Seq: master.Seq + uint64(id[2])},
+			Fields: fields,
+		})
+	}
+
+	return entries, nil
+}
+
+func rawStreamID(data []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(data[:8]), Seq: binary.BigEndian.Uint64(data[8:])}
+}
+
+// read stream ID stored as two lengths
+func (parser *Parser) readStreamID() (StreamID, error) {
+	ms, _, err := parser.readLength(false)
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := parser.readLength(false)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// read raw 128 bit stream ID
+func (parser *Parser) readRawStreamID() (StreamID, error) {
+	data, err := parser.safeRead(streamIDSize)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return rawStreamID(data), nil
+}
+
+// read millisecond time stored as raw little endian uint64
+func (parser *Parser) readMillisecondTime() (uint64, error) {
+	data, err := parser.safeRead(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// read consumer group with its PEL and consumers
+func (parser *Parser) readStreamGroup(version int) (*StreamGroup, error) {
+	name, err := parser.readString(false)
+	if err != nil {
+		return nil, err
+	}
+	group := &StreamGroup{Name: name, EntriesRead: -1}
+
+	group.LastID, err = parser.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > 1 {
+		entriesRead, _, err := parser.readLength(false)
+		if err != nil {
+			return nil, err
+		}
+		// SCG_INVALID_ENTRIES_READ is saved as -1
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pending, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < pending; i++ {
+		entry := &StreamPendingEntry{}
+		entry.ID, err = parser.readRawStreamID()
+		if err != nil {
+			return nil, err
+		}
+		entry.DeliveryTime, err = parser.readMillisecondTime()
+		if err != nil {
+			return nil, err
+		}
+		entry.DeliveryCount, _, err = parser.readLength(false)
+		if err != nil {
+			return nil, err
+		}
+		group.Pending = append(group.Pending, entry)
+	}
+
+	consumers, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < consumers; i++ {
+		consumer := &StreamConsumer{}
+		consumer.Name, err = parser.readString(false)
+		if err != nil {
+			return nil, err
+		}
+
+		consumer.SeenTime, err = parser.readMillisecondTime()
+		if err != nil {
+			return nil, err
+		}
+		if version > 2 {
+			consumer.ActiveTime, err = parser.readMillisecondTime()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		owned, _, err := parser.readLength(false)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < owned; j++ {
+			id, err := parser.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+			consumer.Pending = append(consumer.Pending, id)
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+
+	return group, nil
+}
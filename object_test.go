@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expected object as written in cases/*.json
+type jsonObject struct {
+	DB         int               `json:"db"`
+	Key        string            `json:"key"`
+	Type       string            `json:"type"`
+	Encoding   string            `json:"encoding"`
+	Expiration *time.Time        `json:"expiration"`
+	Value      string            `json:"value"`
+	Values     []string          `json:"values"`
+	Members    []string          `json:"members"`
+	Hash       map[string]string `json:"hash"`
+	Entries    json.RawMessage   `json:"entries"`
+	LastID     string            `json:"lastId"`
+	Groups     []struct {
+		Name      string `json:"name"`
+		LastID    string `json:"lastId"`
+		Consumers []struct {
+			Name    string   `json:"name"`
+			Pending []string `json:"pending"`
+		} `json:"consumers"`
+	} `json:"groups"`
+}
+
+func objectTest(t *testing.T, path string) {
+	fileObj, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileObj.Close()
+
+	ch1 := make(chan RedisObject, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseObjects(bufio.NewReader(fileObj), ch1)
+		close(ch1)
+	}()
+
+	objects := map[string]RedisObject{}
+	for obj := range ch1 {
+		objects[obj.GetKey()] = obj
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(strings.TrimSuffix(path, ".rdb") + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []jsonObject
+	if err := json.Unmarshal(contents, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != len(expected) {
+		t.Errorf("%s: got %d keys, expected %d", path, len(objects), len(expected))
+	}
+
+	for _, exp := range expected {
+		obj, ok := objects[exp.Key]
+		if !ok {
+			t.Errorf("%s: key %q missing", path, exp.Key)
+			continue
+		}
+		if obj.GetDB() != exp.DB || obj.GetType() != exp.Type || obj.GetEncoding() != exp.Encoding {
+			t.Errorf("%s: key %q is %d/%s/%s, expected %d/%s/%s", path, exp.Key,
+				obj.GetDB(), obj.GetType(), obj.GetEncoding(), exp.DB, exp.Type, exp.Encoding)
+		}
+		if exp.Expiration != nil && obj.GetExpireAt() != uint64(exp.Expiration.UnixMilli()) {
+			t.Errorf("%s: key %q expires at %d, expected %s", path, exp.Key, obj.GetExpireAt(), exp.Expiration)
+		}
+
+		var got, want interface{}
+		switch obj := obj.(type) {
+		case *StringObject:
+			// JSON replaces every invalid UTF-8 byte with U+FFFD
+			got, want = string([]rune(obj.Value)), exp.Value
+		case *ListObject:
+			got, want = obj.Values, exp.Values
+		case *SetObject:
+			members := append([]string{}, obj.Members...)
+			sort.Strings(members)
+			sort.Strings(exp.Members)
+			got, want = members, exp.Members
+		case *HashObject:
+			hash := map[string]string{}
+			for _, field := range obj.Fields {
+				hash[field.Field] = field.Value
+			}
+			got, want = hash, exp.Hash
+		case *ZSetObject:
+			var entries []struct {
+				Member string  `json:"member"`
+				Score  float64 `json:"score"`
+			}
+			if err := json.Unmarshal(exp.Entries, &entries); err != nil {
+				t.Fatal(err)
+			}
+			scores, expScores := map[string]float64{}, map[string]float64{}
+			for _, entry := range obj.Entries {
+				scores[entry.Member] = entry.Score
+			}
+			for _, entry := range entries {
+				expScores[entry.Member] = entry.Score
+			}
+			got, want = scores, expScores
+		case *StreamObject:
+			var entries []struct {
+				ID     string   `json:"id"`
+				Fields []string `json:"fields"`
+			}
+			if err := json.Unmarshal(exp.Entries, &entries); err != nil {
+				t.Fatal(err)
+			}
+			var ids, expIDs []string
+			for _, entry := range obj.Entries {
+				ids = append(ids, entry.ID.String()+" "+strings.Join(entry.Fields, " "))
+			}
+			for _, entry := range entries {
+				expIDs = append(expIDs, entry.ID+" "+strings.Join(entry.Fields, " "))
+			}
+			for _, group := range obj.Groups {
+				ids = append(ids, group.Name+" "+group.LastID.String())
+				for _, consumer := range group.Consumers {
+					for _, id := range consumer.Pending {
+						ids = append(ids, consumer.Name+" "+id.String())
+					}
+				}
+			}
+			for _, group := range exp.Groups {
+				expIDs = append(expIDs, group.Name+" "+group.LastID)
+				for _, consumer := range group.Consumers {
+					for _, id := range consumer.Pending {
+						expIDs = append(expIDs, consumer.Name+" "+id)
+					}
+				}
+			}
+			ids = append(ids, obj.LastID.String())
+			expIDs = append(expIDs, exp.LastID)
+			got, want = ids, expIDs
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: key %q decoded as %v, expected %v", path, exp.Key, got, want)
+		}
+	}
+}
+
+func Test_objects(t *testing.T) {
+	files, err := filepath.Glob("./cases/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range files {
+		path := strings.TrimSuffix(path, ".json") + ".rdb"
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			objectTest(t, path)
+		})
+	}
+}
+
+// scores of RDB_TYPE_ZSET_2 are binary doubles, RESTORE payload must keep them
+func Test_zset2_restore(t *testing.T) {
+	fileObj, err := os.Open("./cases/rdb_version_8_with_64b_length_and_scores.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileObj.Close()
+
+	ch1 := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseRDB(bufio.NewReader(fileObj), ch1, nil)
+		close(ch1)
+	}()
+
+	var payload []byte
+	for cmd := range ch1 {
+		if cmd.Command[0] == restoreCommand && cmd.Command[1] == "bigset" {
+			payload = []byte(cmd.Command[3])
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) < 10 {
+		t.Fatalf("payload %q", payload)
+	}
+
+	// RDB version and CRC64 follow value
+	obj, err := decodeObject(&BaseObject{Key: "bigset"}, payload[:len(payload)-10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores := map[float64]int{}
+	for _, entry := range obj.(*ZSetObject).Entries {
+		scores[entry.Score]++
+	}
+	if !reflect.DeepEqual(scores, map[float64]int{1.618: 999, 2.718: 1}) {
+		t.Errorf("scores %v", scores)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+// Parallel writer: commands are spread over several connections, possibly to several proxies, keeping per-key order
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// connection with its own writer goroutine
+type lane struct {
+	addr     string
+	target   *singleTarget
+	commands chan *RedisCommand
+	done     chan struct{}
+	// result of laneBarrier, sent when every earlier command of lane is answered
+	idle chan error
+
+	err     error
+	errLock sync.Mutex
+}
+
+// queued on lane to wait for replies of its earlier commands
+var laneBarrier = &RedisCommand{}
+
+// key with commands waiting for reply on lane
+type laneKey struct {
+	lane    *lane
+	pending int
+}
+
+// ParallelTarget writes over several connections, large commands use separate lanes so they don't delay small ones
+type ParallelTarget struct {
+	lanes     []*lane
+	large     []*lane
+	largeSize int64
+	stats     *SendStats
+
+	// commands of key in flight pin it to their lane, so commands of one key are never reordered
+	keysLock sync.Mutex
+	keys     map[string]*laneKey
+}
+
+// NewParallelTarget dials connections to addrs round robin, every addr gets at least one, largeSize 0 disables large
+// lanes
+func NewParallelTarget(addrs []string, password string, connections int, largeConnections int, largeSize int64, pipeline int) (*ParallelTarget, error) {
+	if connections < len(addrs) {
+		connections = len(addrs)
+	}
+	if largeSize <= 0 {
+		largeConnections = 0
+	}
+
+	t := &ParallelTarget{
+		largeSize: largeSize,
+		stats:     NewSendStats(),
+		keys:      map[string]*laneKey{},
+	}
+
+	for i := 0; i < connections+largeConnections; i++ {
+		conn, err := getConn(addrs[i%len(addrs)], password)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+
+		l := t.newLane(addrs[i%len(addrs)], conn, pipeline)
+		if i < connections {
+			t.lanes = append(t.lanes, l)
+		} else {
+			t.large = append(t.large, l)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *ParallelTarget) newLane(addr string, conn redis.Conn, pipeline int) *lane {
+	l := &lane{
+		addr:     addr,
+		target:   newSingleTarget(conn, pipeline, t.stats, t.replied),
+		commands: make(chan *RedisCommand, pipeline),
+		done:     make(chan struct{}),
+		idle:     make(chan error),
+	}
+	go l.run()
+	return l
+}
+
+// write commands, flushing whenever lane is idle
+func (l *lane) run() {
+	defer close(l.done)
+
+	for cmd := range l.commands {
+		if cmd == laneBarrier {
+			l.idle <- l.wait()
+			continue
+		}
+		// after error commands are only drained
+		if l.error() != nil {
+			continue
+		}
+
+		err := l.target.Send(cmd)
+		if err == nil && len(l.commands) == 0 {
+			err = l.target.Flush()
+		}
+		if err != nil {
+			l.errLock.Lock()
+			l.err = err
+			l.errLock.Unlock()
+		}
+	}
+}
+
+// wait for replies of all written commands
+func (l *lane) wait() error {
+	err := l.error()
+	if err != nil {
+		return err
+	}
+
+	err = l.target.wait()
+	if err != nil {
+		l.errLock.Lock()
+		l.err = err
+		l.errLock.Unlock()
+	}
+	return err
+}
+
+func (l *lane) error() error {
+	l.errLock.Lock()
+	defer l.errLock.Unlock()
+	return l.err
+}
+
+// Send queues command on lane of its keys, command whose keys are pinned to different lanes waits for every lane
+func (t *ParallelTarget) Send(cmd *RedisCommand) error {
+	keys := laneKeys(cmd)
+
+	t.keysLock.Lock()
+	l, ok := t.pinned(keys)
+	if !ok {
+		t.keysLock.Unlock()
+		// every command is answered after barrier, so no key stays pinned
+		err := t.barrier(append(t.lanes, t.large...))
+		if err != nil {
+			return err
+		}
+		t.keysLock.Lock()
+		l, _ = t.pinned(keys)
+	}
+	if l == nil {
+		l = t.lane(cmd)
+	}
+	for _, k := range keys {
+		key, ok := t.keys[k]
+		if !ok {
+			key = &laneKey{lane: l}
+			t.keys[k] = key
+		}
+		key.pending++
+	}
+	t.keysLock.Unlock()
+
+	err := l.error()
+	if err != nil {
+		return err
+	}
+	l.commands <- cmd
+	return nil
+}
+
+// lane holding keys, nil when none is pinned, false when they are pinned to different lanes
+func (t *ParallelTarget) pinned(keys []string) (*lane, bool) {
+	var l *lane
+	for _, k := range keys {
+		key, ok := t.keys[k]
+		if !ok {
+			continue
+		}
+		if l != nil && key.lane != l {
+			return nil, false
+		}
+		l = key.lane
+	}
+	return l, true
+}
+
+// keys pinning lane of command, every key of multi-key command
+func laneKeys(cmd *RedisCommand) []string {
+	if len(cmd.Keys) > 1 {
+		return cmd.Keys
+	}
+	return []string{cmd.Key}
+}
+
+// SendAll sends command once for every address, it is barrier: commands sent before are answered on every lane
+// before it is written, commands sent after it are written once it is answered
+func (t *ParallelTarget) SendAll(cmd *RedisCommand) error {
+	err := t.barrier(append(t.lanes, t.large...))
+	if err != nil {
+		return err
+	}
+
+	var sent []*lane
+	seen := map[string]bool{}
+	for _, l := range t.lanes {
+		if seen[l.addr] {
+			continue
+		}
+		seen[l.addr] = true
+
+		l.commands <- cmd
+		sent = append(sent, l)
+	}
+	return t.barrier(sent)
+}
+
+// wait until every command queued on lanes is answered, only sender queues commands, so lanes stay idle after it
+func (t *ParallelTarget) barrier(lanes []*lane) error {
+	for _, l := range lanes {
+		l.commands <- laneBarrier
+	}
+
+	var result error
+	for _, l := range lanes {
+		err := <-l.idle
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// lane of key without commands in flight, chosen by hash of key
+func (t *ParallelTarget) lane(cmd *RedisCommand) *lane {
+	lanes := t.lanes
+	if len(t.large) > 0 && cmd.BulkSize >= t.largeSize {
+		lanes = t.large
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(cmd.Key))
+	return lanes[hash.Sum32()%uint32(len(lanes))]
+}
+
+// key is unpinned when last of its commands is answered
+func (t *ParallelTarget) replied(cmd *RedisCommand) {
+	if cmd.AllNodes {
+		return
+	}
+
+	t.keysLock.Lock()
+	defer t.keysLock.Unlock()
+
+	for _, k := range laneKeys(cmd) {
+		key, ok := t.keys[k]
+		if !ok {
+			continue
+		}
+		key.pending--
+		if key.pending <= 0 {
+			delete(t.keys, k)
+		}
+	}
+}
+
+// Flush does nothing, lanes flush themselves when idle
+func (t *ParallelTarget) Flush() error {
+	for _, l := range append(t.lanes, t.large...) {
+		err := l.error()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close waits for all lanes and closes connections
+func (t *ParallelTarget) Close() error {
+	var result error
+	for _, l := range append(t.lanes, t.large...) {
+		close(l.commands)
+		<-l.done
+
+		err := l.error()
+		if err == nil {
+			err = l.target.Close()
+		} else {
+			l.target.Close()
+		}
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Stats counts replies of all connections
+func (t *ParallelTarget) Stats() *SendStats {
+	return t.stats
+}
+
+// target addresses of -proxy-addrs, proxy-host:proxy-port when empty
+func proxyAddrs(addr string) []string {
+	if ProxyAddrs == "" {
+		return []string{addr}
+	}
+
+	var addrs []string
+	for _, a := range strings.Split(ProxyAddrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelTarget(t *testing.T) {
+	var lock sync.Mutex
+	// values of every key in order they were received
+	values := map[string][]string{}
+	received := func(args []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		values[args[1]] = append(values[args[1]], args[2])
+	}
+	addrs := []string{fakeRedis(t, received), fakeRedis(t, received)}
+
+	target, err := NewParallelTarget(addrs, "", 3, 1, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		for k := 0; k < 20; k++ {
+			value := fmt.Sprint(i)
+			// every third key is sometimes large
+			if k%3 == 0 && i%7 == 0 {
+				value += strings.Repeat("x", 100)
+			}
+			key := fmt.Sprint("key", k)
+			cmd := &RedisCommand{Command: []string{"SET", key, value}, Key: key}
+			cmd.BulkSize = cmd.size()
+			if err := target.Send(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := target.Stats(); stats.OK() != 1000 || stats.Failed() != 0 {
+		t.Errorf("%d ok and %d failed, expected 1000 and 0", stats.OK(), stats.Failed())
+	}
+	if len(values) != 20 {
+		t.Fatalf("%d keys received, expected 20", len(values))
+	}
+	for key, received := range values {
+		if len(received) != 50 {
+			t.Fatalf("key %s received %d times", key, len(received))
+		}
+		for i, value := range received {
+			if !strings.HasPrefix(value, fmt.Sprint(i)) || len(strings.TrimRight(value, "x")) != len(fmt.Sprint(i)) {
+				t.Fatalf("key %s received %q as %d. value", key, value, i)
+			}
+		}
+	}
+	if len(target.keys) != 0 {
+		t.Errorf("%d keys still pinned to lanes", len(target.keys))
+	}
+}
+
+func TestParallelTargetAddrs(t *testing.T) {
+	addrs := []string{fakeRedis(t, func([]string) {}), fakeRedis(t, func([]string) {}), fakeRedis(t, func([]string) {})}
+
+	// a single connection still goes to every proxy
+	target, err := NewParallelTarget(addrs, "", 1, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	var got []string
+	for _, l := range target.lanes {
+		got = append(got, l.addr)
+	}
+	if !reflect.DeepEqual(got, addrs) {
+		t.Errorf("lanes to %q, expected %q", got, addrs)
+	}
+}
+
+func TestParallelTargetSendAll(t *testing.T) {
+	var lock sync.Mutex
+	var applied []string
+	addr := fakeRedis(t, func(args []string) {
+		// slow commands would be overtaken by commands of other lanes
+		if args[0] == "FLUSHDB" || args[1] == "before" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		applied = append(applied, args[0]+" "+args[len(args)-1])
+	})
+
+	target, err := NewParallelTarget([]string{addr}, "", 4, 0, 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys on other lanes than FLUSHDB, which goes to first lane
+	cmd := func(value string) *RedisCommand {
+		for i := 0; ; i++ {
+			key := fmt.Sprint("key", i)
+			cmd := &RedisCommand{Command: []string{"SET", key, value}, Key: key}
+			if target.lane(cmd) != target.lanes[0] {
+				return cmd
+			}
+		}
+	}
+
+	for _, c := range []*RedisCommand{cmd("before"), {Command: []string{"FLUSHDB"}, AllNodes: true}, cmd("after")} {
+		if c.AllNodes {
+			err = target.SendAll(c)
+		} else {
+			err = target.Send(c)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := []string{"SET before", "FLUSHDB FLUSHDB", "SET after"}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("applied %q, expected %q", applied, expected)
+	}
+}
+
+func TestParallelTargetMultiKey(t *testing.T) {
+	var lock sync.Mutex
+	var applied []string
+	addr := fakeRedis(t, func(args []string) {
+		// RENAME would be overtaken by SET of its second key on other lane
+		if args[0] == "RENAME" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		applied = append(applied, strings.Join(args, " "))
+	})
+
+	target, err := NewParallelTarget([]string{addr}, "", 4, 0, 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// second key hashes to other lane than first
+	from := &RedisCommand{Key: "a"}
+	to := &RedisCommand{Key: "b"}
+	for i := 0; target.lane(to) == target.lane(from); i++ {
+		to.Key = fmt.Sprint("b", i)
+	}
+
+	for _, c := range []*RedisCommand{
+		{Command: []string{"RENAME", from.Key, to.Key}, Key: from.Key, Keys: []string{from.Key, to.Key}},
+		{Command: []string{"SET", to.Key, "v"}, Key: to.Key},
+	} {
+		if err := target.Send(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := []string{"RENAME a " + to.Key, "SET " + to.Key + " v"}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("applied %q, expected %q", applied, expected)
+	}
+	if len(target.keys) != 0 {
+		t.Errorf("%d keys still pinned to lanes", len(target.keys))
+	}
+}
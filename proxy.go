@@ -0,0 +1,477 @@
+package main
+
+// Filtering replication proxy: replicas connect with SYNC/PSYNC and get RDB and command stream of their shard only
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// master pings replicas every repl-ping-replica-period
+	proxyPingInterval = 10 * time.Second
+	// newlines keep replica waiting while master prepares RDB
+	proxyKeepaliveInterval = time.Second
+)
+
+var (
+	// ErrProxyConfig is returned when replication proxy misses master or pool
+	ErrProxyConfig = errors.New("proxy: -replication-proxy needs -master and -nutcracker-conf")
+)
+
+// ReplicationProxy relays replication of master to replicas which are servers of pool, filtered by key owner
+type ReplicationProxy struct {
+	master         string
+	masterPassword string
+	password       string
+	pool           *TwemproxyPool
+
+	listener net.Listener
+}
+
+// downstream replica
+type proxyReplica struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	authenticated bool
+	// announced by REPLCONF
+	ip   string
+	port string
+	eof  bool
+
+	server *TwemproxyServer
+	db     int
+}
+
+// NewReplicationProxy listens on addr, password is required from replicas when not empty
+func NewReplicationProxy(addr string, master string, masterPassword string, password string, pool *TwemproxyPool) (*ReplicationProxy, error) {
+	if pool.Distribution == "random" {
+		return nil, ErrRandomDistribution
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReplicationProxy{
+		master:         master,
+		masterPassword: masterPassword,
+		password:       password,
+		pool:           pool,
+		listener:       listener,
+	}, nil
+}
+
+// Addr returns listening address
+func (p *ReplicationProxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Serve accepts replicas until listener is closed, every replica has its own connection to master
+func (p *ReplicationProxy) Serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serve(conn)
+	}
+}
+
+// Close stops accepting replicas
+func (p *ReplicationProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *ReplicationProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	replica := &proxyReplica{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		db:     -1,
+	}
+
+	psync, err := p.handshake(replica)
+	if err == nil {
+		err = p.sync(replica, psync)
+	}
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "proxy: replica %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// answer commands of replica until SYNC or PSYNC
+func (p *ReplicationProxy) handshake(r *proxyReplica) (psync bool, err error) {
+	for {
+		args, _, err := readCommand(r.reader)
+		if err != nil {
+			return false, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		if p.password != "" && !r.authenticated && name != "AUTH" {
+			err = r.reply("-NOAUTH Authentication required.")
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		switch name {
+		case "PING":
+			err = r.reply("+PONG")
+		case "AUTH":
+			if len(args) < 2 || len(args) > 3 {
+				err = r.reply("-ERR wrong number of arguments for 'auth' command")
+			} else if args[len(args)-1] != p.password {
+				err = r.reply("-WRONGPASS invalid username-password pair or user is disabled.")
+			} else {
+				r.authenticated = true
+				err = r.reply("+OK")
+			}
+		case "REPLCONF":
+			for i := 1; i+1 < len(args); i += 2 {
+				switch strings.ToLower(args[i]) {
+				case "listening-port":
+					r.port = args[i+1]
+				case "ip-address":
+					r.ip = args[i+1]
+				case "capa":
+					r.eof = r.eof || strings.EqualFold(args[i+1], "eof")
+				}
+			}
+			err = r.reply("+OK")
+		case "SYNC":
+			return false, nil
+		case "PSYNC":
+			return true, nil
+		default:
+			err = r.reply(fmt.Sprintf("-ERR unknown command '%s'", args[0]))
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// server of pool the replica is, by announced address
+func (p *ReplicationProxy) shard(r *proxyReplica) (*TwemproxyServer, error) {
+	if r.port == "" {
+		return nil, fmt.Errorf("proxy: replica didn't announce its listening-port")
+	}
+
+	ip := r.ip
+	if ip == "" {
+		host, _, err := net.SplitHostPort(r.conn.RemoteAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		ip = host
+	}
+
+	for _, server := range p.pool.Servers {
+		host, port, err := net.SplitHostPort(server.Addr)
+		if err != nil || port != r.port {
+			continue
+		}
+		if host == ip {
+			return server, nil
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr == ip {
+				return server, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("proxy: replica %s isn't a server of pool %s", net.JoinHostPort(ip, r.port), p.pool.Name)
+}
+
+// full resync of replica: filtered RDB followed by filtered command stream
+func (p *ReplicationProxy) sync(r *proxyReplica, psync bool) error {
+	server, err := p.shard(r)
+	if err != nil {
+		r.reply("-ERR " + err.Error())
+		return err
+	}
+	r.server = server
+
+	source, err := NewReplicationSource(p.master, p.masterPassword)
+	if err != nil {
+		r.reply("-ERR " + err.Error())
+		return err
+	}
+	defer source.Close()
+
+	if psync {
+		// replica gets own replication id, offsets of filtered stream differ from master's
+		err = r.reply(fmt.Sprintf("+FULLRESYNC %s 0", randomReplID()))
+		if err != nil {
+			return err
+		}
+	}
+
+	stopKeepalive := r.keepalive()
+	defer stopKeepalive()
+
+	err = source.ReadRDB(func(reader *bufio.Reader) error {
+		stopKeepalive()
+		return p.sendRDB(r, reader)
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.stream(r, source)
+}
+
+// write newline every second until returned function is called
+func (r *proxyReplica) keepalive() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(proxyKeepaliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.writer.WriteByte('\n')
+				if r.writer.Flush() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// RDB with keys of replica shard only, diskless framing when replica supports it
+func (p *ReplicationProxy) sendRDB(r *proxyReplica, reader *bufio.Reader) error {
+	header, err := reader.Peek(len(rdbSignature) + 4)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(string(header[len(rdbSignature):]))
+	if err != nil {
+		return ErrWrongSignature
+	}
+
+	var out io.Writer = r.writer
+	var file *os.File
+	mark := randomReplID()
+	if r.eof {
+		_, err = fmt.Fprintf(r.writer, "$%s%s\r\n", replicationEOFPrefix, mark)
+		if err != nil {
+			return err
+		}
+	} else {
+		// length must be known before RDB, it is written to disk first like by master without diskless sync
+		file, err = os.CreateTemp("", "redis-proxy-resharding-*.rdb")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		out = bufio.NewWriter(file)
+	}
+
+	writer, err := NewRDBWriter(out, version)
+	if err != nil {
+		return err
+	}
+
+	entries := make(chan *RDBEntry, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseEntries(reader, entries)
+		close(entries)
+	}()
+
+	// entries are drained even after write error, parser must finish
+	for entry := range entries {
+		// function libraries go to every replica
+		if err == nil && (entry.Function || p.pool.Server(entry.Key) == r.server) {
+			err = writer.WriteEntry(entry)
+		}
+	}
+	if parseErr := <-errs; parseErr != nil {
+		return parseErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if r.eof {
+		_, err = r.writer.WriteString(mark)
+	} else {
+		err = r.sendFile(file, out.(*bufio.Writer))
+	}
+	if err != nil {
+		return err
+	}
+	return r.writer.Flush()
+}
+
+// RDB written to file is sent with its length
+func (r *proxyReplica) sendFile(file *os.File, out *bufio.Writer) error {
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(r.writer, "$%d\r\n", size)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(r.writer, file, size)
+	return err
+}
+
+// forward commands of replica shard until master or replica disconnects
+func (p *ReplicationProxy) stream(r *proxyReplica, source *ReplicationSource) error {
+	output := make(chan *RedisCommand, 64)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source.Follow(output)
+		close(output)
+	}()
+	defer func() {
+		source.Close()
+		for range output {
+		}
+	}()
+
+	// ACKs of replica aren't needed, master connection is closed when replica goes away
+	go func() {
+		io.Copy(io.Discard, r.reader)
+		source.Close()
+	}()
+
+	ping := time.NewTicker(proxyPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case cmd, ok := <-output:
+			if !ok {
+				return <-errs
+			}
+			// keyless writes go to every replica, multi-key commands only when all keys are on the same server
+			if !cmd.AllNodes && p.pool.Server(cmd.Key) != r.server {
+				continue
+			}
+			if !cmd.sameOwner(p.pool.Owner) {
+				fmt.Fprintf(os.Stderr, "proxy: %s of %q not forwarded, keys belong to different servers\n", cmd.Command[0], cmd.Key)
+				continue
+			}
+
+			err := r.send(cmd)
+			if err != nil {
+				return err
+			}
+			if len(output) > 0 {
+				continue
+			}
+		case <-ping.C:
+			err := writeCommand(r.writer, "PING")
+			if err != nil {
+				return err
+			}
+		}
+
+		err := r.writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write command preceded by SELECT when database changes
+func (r *proxyReplica) send(cmd *RedisCommand) error {
+	if cmd.DB != r.db {
+		err := writeCommand(r.writer, "SELECT", strconv.Itoa(cmd.DB))
+		if err != nil {
+			return err
+		}
+		r.db = cmd.DB
+	}
+	return writeCommand(r.writer, cmd.Command...)
+}
+
+func (r *proxyReplica) reply(line string) error {
+	r.writer.WriteString(line)
+	r.writer.WriteString("\r\n")
+	return r.writer.Flush()
+}
+
+// 40 random hex characters, as replication id and EOF mark of redis
+func randomReplID() string {
+	buf := make([]byte, replicationMarkSize/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// run replication proxy with -replication-proxy
+func serveReplicationProxy() error {
+	if Master == "" || NutcrackerConf == "" {
+		return ErrProxyConfig
+	}
+
+	pool, err := LoadTwemproxyPool(NutcrackerConf, NutcrackerPool)
+	if err != nil {
+		return err
+	}
+
+	proxy, err := NewReplicationProxy(fmt.Sprintf("%s:%d", proxyHost, proxyPort), Master, MasterPassword, proxyPassword, pool)
+	if err != nil {
+		return err
+	}
+	return proxy.Serve()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReplicationProxy(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := NewTwemproxyPool("fnv1a_64", "", "modula", []*TwemproxyServer{
+		{Addr: "127.0.0.1:7001", Name: "127.0.0.1:7001", Weight: 1},
+		{Addr: "127.0.0.1:7002", Name: "127.0.0.1:7002", Weight: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := pool.Servers[0]
+
+	// command stream with keys of both shards
+	var stream bytes.Buffer
+	writer := bufio.NewWriter(&stream)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		writeCommand(writer, "SET", key, "value")
+		if pool.Server(key) == shard {
+			expected = append(expected, "SET "+key+" value")
+		}
+	}
+	writer.Flush()
+
+	// fake master serves single replica
+	newProxy := func() *ReplicationProxy {
+		master := fakeMaster(t, rdb, true, testReplID, stream.String(), nil)
+		proxy, err := NewReplicationProxy("127.0.0.1:0", master, "secret", "", pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { proxy.Close() })
+		go proxy.Serve()
+		return proxy
+	}
+
+	for _, eof := range []bool{false, true} {
+		replicaTest(t, newProxy().Addr().String(), eof, rdb, pool, shard, expected)
+	}
+	proxy := newProxy()
+
+	// replica which isn't server of pool is refused
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, r := bufio.NewWriter(conn), bufio.NewReader(conn)
+	writeCommand(w, "REPLCONF", "listening-port", "7003")
+	writeCommand(w, "PSYNC", "?", "-1")
+	w.Flush()
+	readLine(r)
+	if line, _ := readLine(r); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("unknown replica gets %q", line)
+	}
+}
+
+func replicaTest(t *testing.T, addr string, eof bool, rdb []byte, pool *TwemproxyPool, shard *TwemproxyServer, expected []string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, r := bufio.NewWriter(conn), bufio.NewReader(conn)
+
+	_, port, _ := net.SplitHostPort(shard.Addr)
+	writeCommand(w, "PING")
+	writeCommand(w, "REPLCONF", "listening-port", port)
+	if eof {
+		writeCommand(w, "REPLCONF", "capa", "eof", "capa", "psync2")
+	} else {
+		writeCommand(w, "REPLCONF", "capa", "psync2")
+	}
+	writeCommand(w, "PSYNC", "?", "-1")
+	w.Flush()
+
+	for _, expected := range []string{"+PONG", "+OK", "+OK"} {
+		if line, _ := readLine(r); line != expected {
+			t.Fatalf("handshake reply %q, expected %q", line, expected)
+		}
+	}
+	if line, _ := readLine(r); !strings.HasPrefix(line, "+FULLRESYNC ") {
+		t.Fatalf("PSYNC reply %q", line)
+	}
+
+	// keepalive newlines may come before RDB
+	header := ""
+	for header == "" {
+		header, err = readLine(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var body []byte
+	if eof {
+		if !strings.HasPrefix(header, "$EOF:") {
+			t.Fatalf("RDB header %q", header)
+		}
+		mark := header[5:]
+		var buf bytes.Buffer
+		for !bytes.HasSuffix(buf.Bytes(), []byte(mark)) {
+			c, err := r.ReadByte()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteByte(c)
+		}
+		body = buf.Bytes()[:buf.Len()-len(mark)]
+	} else {
+		length, err := strconv.Atoi(strings.TrimPrefix(header, "$"))
+		if err != nil {
+			t.Fatalf("RDB header %q", header)
+		}
+		body = make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want []RedisObject
+	for _, obj := range parseAllObjects(t, rdb) {
+		if pool.Server(obj.GetKey()) == shard {
+			want = append(want, obj)
+		}
+	}
+	if got := parseAllObjects(t, body); !reflect.DeepEqual(got, want) || len(want) == 0 {
+		t.Errorf("replica got %d keys, expected %d", len(got), len(want))
+	}
+
+	var got []string
+	for len(got) < len(expected) {
+		args, _, err := readCommand(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args[0] != "SELECT" {
+			got = append(got, strings.Join(args, " "))
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("replica got stream %q, expected %q", got, expected)
+	}
+}
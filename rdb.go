@@ -10,17 +10,26 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	rdbOpAux        = 0xFA
-	rdbOpResizeDB   = 0xFB
-	rdbOpDB         = 0xFE
-	rdbOpExpirySec  = 0xFD
-	rdbOpExpiryMSec = 0xFC
-	rdbOpEOF        = 0xFF
+	rdbOpSlotInfo      = 0xF4
+	rdbOpFunction2     = 0xF5
+	rdbOpFunctionPreGA = 0xF6
+	rdbOpIdle          = 0xF8
+	rdbOpFreq          = 0xF9
+	rdbOpAux           = 0xFA
+	rdbOpResizeDB      = 0xFB
+	rdbOpDB            = 0xFE
+	rdbOpExpirySec     = 0xFD
+	rdbOpExpiryMSec    = 0xFC
+	rdbOpEOF           = 0xFF
 
 	rdbLen6Bit  = 0x0
 	rdbLen14bit = 0x1
@@ -30,20 +39,36 @@ const (
 	Type32Bit = 0x80
 	Type64Bit = 0x81
 
-	rdbOpString          = 0x00
-	rdbOpList            = 0x01
-	rdbOpSet             = 0x02
-	rdbOpZset            = 0x03
-	rdbOpHash            = 0x04
-	rdbOpZset2           = 0x05
-	rdbOpModule2         = 0x07
-	rdbOpZipmap          = 0x09
-	rdbOpZiplist         = 0x0a
-	rdbOpIntset          = 0x0b
-	rdbOpSortedSet       = 0x0c
-	rdbOpHashmap         = 0x0d
-	rdbOpListQuicklist   = 0x0e
-	rdbOpStreamListpacks = 0x0f
+	rdbOpString           = 0x00
+	rdbOpList             = 0x01
+	rdbOpSet              = 0x02
+	rdbOpZset             = 0x03
+	rdbOpHash             = 0x04
+	rdbOpZset2            = 0x05
+	rdbOpModule2          = 0x07
+	rdbOpZipmap           = 0x09
+	rdbOpZiplist          = 0x0a
+	rdbOpIntset           = 0x0b
+	rdbOpSortedSet        = 0x0c
+	rdbOpHashmap          = 0x0d
+	rdbOpListQuicklist    = 0x0e
+	rdbOpStreamListpacks  = 0x0f
+	rdbOpHashListpack     = 0x10
+	rdbOpZsetListpack     = 0x11
+	rdbOpListQuicklist2   = 0x12
+	rdbOpStreamListpacks2 = 0x13
+	rdbOpSetListpack      = 0x14
+	rdbOpStreamListpacks3 = 0x15
+	// hash with field expiration of redis 7.4, pre-release types have absolute field TTLs
+	rdbOpHashMetadataPreGA   = 0x16
+	rdbOpHashListpackExPreGA = 0x17
+	rdbOpHashMetadata        = 0x18
+	rdbOpHashListpackEx      = 0x19
+
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	streamIDSize = 16
 
 	RdbModuleOpcodeEOF    = 0
 	RdbModuleOpcodeSInt   = 1
@@ -53,10 +78,17 @@ const (
 	RdbModuleOpcodeString = 5
 )
 
+const rdbMaxVersion = 12
+
+// first keys outside slot announced by slot info are printed, the rest is only counted
+const rdbMaxReportedSlotErrors = 10
+
 var (
 	rdbSignature     = []byte{0x52, 0x45, 0x44, 0x49, 0x53}
 	restoreCommand   = "RESTORE"
 	currentTimestamp = uint64(0)
+	// clock is shared by all parsers, it is started by the first one
+	cronOnce sync.Once
 )
 
 var (
@@ -68,24 +100,52 @@ var (
 	ErrUnsupportedOp = errors.New("rdb: unsupported opcode")
 	// ErrUnsupportedStringEnc is returned when unsupported string encoding is encountered in RDB
 	ErrUnsupportedStringEnc = errors.New("rdb: unsupported string encoding")
+	// ErrChecksum is returned when CRC64 at the end of RDB doesn't match its contents
+	ErrChecksum = errors.New("rdb: checksum mismatch")
 )
 
 type RedisCommand struct {
 	Command  []string
+	Key      string
+	DB       int
 	BulkSize int64
+	// command has no key and goes to every node, e.g. FUNCTION RESTORE
+	AllNodes bool
+	// every key of multi-key command, Key is the first of them, empty for single key
+	Keys []string
+	// replication offset after command, 0 outside of replication stream
+	Offset int64
 }
 
 // Parser holds internal state of RDB parser while running
 type Parser struct {
-	reader *bufio.Reader
-	output chan *RedisCommand
+	reader  *bufio.Reader
+	output  chan *RedisCommand
+	objects chan RedisObject
+	entries chan *RDBEntry
 
 	length int64
-	hash   uint64
-
-	rawData []byte
-	key     string
-	expiry  uint64
+	// CRC64 of bytes read so far
+	hash uint64
+
+	metadata *RDBMetadata
+
+	rawData  []byte
+	db       int
+	key      string
+	expiry   uint64
+	expireAt uint64
+	// LRU idle seconds and LFU counter of key, saved with LRU or LFU maxmemory-policy
+	idle    uint64
+	freq    byte
+	hasIdle bool
+	hasFreq bool
+	// keys skipped by -max-idle or -min-freq
+	cold int64
+	// cluster slot announced by last slot info with its size and keys seen so far, slot is -1 before first slot info
+	slot     int
+	slotSize uint64
+	slotKeys uint64
 
 	counter *uint64
 
@@ -100,15 +160,40 @@ type state func(parser *Parser) (nextstate state, err error)
 // ParseRDB parsers RDB file which is read from reader, sending chunks of data through output channel
 // length is original length of RDB file
 func ParseRDB(reader *bufio.Reader, output chan *RedisCommand, counter *uint64) (err error) {
-	currentTimestamp = uint64(time.Now().Unix())
-	go cron()
+	_, err = ParseRDBMetadata(reader, output, counter)
+	return err
+}
+
+// ParseObjects parsers RDB file which is read from reader, sending decoded value of every key through output channel
+func ParseObjects(reader *bufio.Reader, output chan RedisObject) (err error) {
+	parser := &Parser{
+		reader:  reader,
+		objects: output,
+	}
+
+	return parser.run()
+}
 
+// ParseEntries parsers RDB file which is read from reader, sending serialized value of every key through output channel
+func ParseEntries(reader *bufio.Reader, output chan *RDBEntry) (err error) {
 	parser := &Parser{
 		reader:  reader,
-		output:  output,
-		counter: counter,
+		entries: output,
 	}
 
+	return parser.run()
+}
+
+// run state machine until RDB is over
+func (parser *Parser) run() (err error) {
+	cronOnce.Do(func() {
+		atomic.StoreUint64(&currentTimestamp, uint64(time.Now().Unix()))
+		go cron()
+	})
+
+	parser.metadata = newRDBMetadata()
+	parser.slot = -1
+
 	state := stateMagic
 
 	for state != nil {
@@ -118,6 +203,13 @@ func ParseRDB(reader *bufio.Reader, output chan *RedisCommand, counter *uint64)
 		}
 	}
 
+	parser.checkSlotSize()
+	if parser.metadata.SlotErrors > 0 {
+		fmt.Fprintf(os.Stderr, "rdb: %d keys outside slot announced by slot info\n", parser.metadata.SlotErrors)
+	}
+	if parser.cold > 0 {
+		fmt.Fprintf(os.Stderr, "rdb: %d cold keys skipped\n", parser.cold)
+	}
 	return nil
 }
 
@@ -127,7 +219,7 @@ func cron() {
 	for {
 		select {
 		case <-ticker.C:
-			currentTimestamp = uint64(time.Now().Unix())
+			atomic.StoreUint64(&currentTimestamp, uint64(time.Now().Unix()))
 		}
 	}
 }
@@ -136,9 +228,20 @@ func cron() {
 func (parser *Parser) safeRead(n uint64) (result []byte, err error) {
 	result = make([]byte, n)
 	_, err = io.ReadFull(parser.reader, result)
+	parser.hash = CRC64Update(parser.hash, result)
 	return
 }
 
+// Read single byte
+func (parser *Parser) readByte() (byte, error) {
+	b, err := parser.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	parser.hash = CRC64Update(parser.hash, []byte{b})
+	return b, nil
+}
+
 // Accumulate some data that might be either parsered out or passed through
 func (parser *Parser) commandWrite(save bool, data []byte) {
 	if !save {
@@ -175,47 +278,127 @@ func toHex(data []byte) string {
 }
 
 // Discard or keep saved data
-func (parser *Parser) keep() {
-	parser.appendVersion()
-	parser.buildCRCData()
+func (parser *Parser) keep() error {
+	var cmds []*RedisCommand
+
+	info := parser.metadata.db(parser.db)
+	info.Keys++
+	if parser.expireAt > 0 {
+		info.Expires++
+	}
+	if parser.slot >= 0 {
+		parser.checkSlot()
+	}
+
+	// only metadata is wanted
+	if parser.output == nil && parser.objects == nil && parser.entries == nil {
+		parser.reset()
+		return nil
+	}
+
+	if parser.entries != nil {
+		parser.entries <- &RDBEntry{
+			DB:       parser.db,
+			Key:      parser.key,
+			ExpireAt: parser.expireAt,
+			Idle:     parser.idle,
+			Freq:     parser.freq,
+			HasIdle:  parser.hasIdle,
+			HasFreq:  parser.hasFreq,
+			Value:    parser.rawData,
+		}
+		parser.reset()
+		return nil
+	}
 
-	var cmd *RedisCommand
-	if Replace {
-		cmd = &RedisCommand{
-			Command: []string{
-				restoreCommand,
-				parser.key,
-				fmt.Sprint(parser.expiry),
-				string(parser.rawData),
-				"REPLACE",
-			},
+	if parser.output != nil && parser.isCold() {
+		parser.cold++
+		parser.reset()
+		return nil
+	}
+
+	if Native || parser.objects != nil {
+		obj, err := decodeObject(&BaseObject{DB: parser.db, Key: parser.key, ExpireAt: parser.expireAt}, parser.rawData)
+		if err != nil {
+			return err
 		}
-	} else {
-		cmd = &RedisCommand{
-			Command: []string{
-				restoreCommand,
-				parser.key,
-				fmt.Sprint(parser.expiry),
-				string(parser.rawData),
-			},
+
+		if parser.objects != nil {
+			parser.objects <- obj
+			parser.reset()
+			return nil
+		}
+
+		cmds, err = objectCommands(obj)
+		if err != nil && err != ErrNoNativeEncoding {
+			return err
 		}
 	}
 
+	if cmds == nil {
+		cmds = []*RedisCommand{parser.restoreCommand()}
+	}
+
 	if !SkipRDB {
-		parser.output <- cmd
+		for _, cmd := range cmds {
+			cmd.Key = parser.key
+			cmd.DB = parser.db
+			emit(parser.output, cmd)
+		}
 
 		if parser.counter != nil {
 			(*parser.counter)++
 		}
 	}
 
+	parser.reset()
+	return nil
+}
+
+// forget saved data of current key
+func (parser *Parser) reset() {
 	parser.rawData = []byte{}
 	parser.expiry = 0
+	parser.expireAt = 0
+	parser.idle = 0
+	parser.freq = 0
+	parser.hasIdle = false
+	parser.hasFreq = false
+}
+
+// key idle for longer than -max-idle or with LFU counter below -min-freq, keys without LRU/LFU info are never cold
+func (parser *Parser) isCold() bool {
+	if MaxIdle > 0 && parser.hasIdle && time.Duration(parser.idle)*time.Second > MaxIdle {
+		return true
+	}
+	return MinFreq > 0 && parser.hasFreq && int(parser.freq) < MinFreq
+}
+
+// build RESTORE command from saved data, eviction info of key is kept by IDLETIME or FREQ
+func (parser *Parser) restoreCommand() *RedisCommand {
+	parser.appendVersion()
+	parser.buildCRCData()
+
+	args := []string{
+		restoreCommand,
+		parser.key,
+		fmt.Sprint(parser.expiry),
+		string(parser.rawData),
+	}
+	if Replace {
+		args = append(args, "REPLACE")
+	}
+	if parser.hasIdle {
+		args = append(args, "IDLETIME", fmt.Sprint(parser.idle))
+	} else if parser.hasFreq {
+		args = append(args, "FREQ", fmt.Sprint(parser.freq))
+	}
+	return &RedisCommand{Command: args}
 }
 
 // Read length encoded prefix
 func (parser *Parser) readLength(save bool) (length uint64, encoding int8, err error) {
-	prefix, err := parser.reader.ReadByte()
+	prefix, err := parser.readByte()
 	if err != nil {
 		return 0, 0, err
 	}
@@ -228,7 +411,7 @@ func (parser *Parser) readLength(save bool) (length uint64, encoding int8, err e
 		length = uint64(prefix & 0x3F)
 		return length, -1, nil
 	case rdbLen14bit: // 0x01
-		data, err := parser.reader.ReadByte()
+		data, err := parser.readByte()
 		if err != nil {
 			return 0, 0, err
 		}
@@ -289,17 +472,8 @@ func (parser *Parser) readString(save bool) (string, error) {
 		}
 		parser.commandWrite(save, data)
 
-		var num uint32
-
-		if encoding == 0 {
-			num = uint32(data[0])
-		} else if encoding == 1 {
-			num = uint32(data[0]) | (uint32(data[1]) << 8)
-		} else if encoding == 2 {
-			num = uint32(data[0]) | (uint32(data[1]) << 8) | (uint32(data[2]) << 16) | (uint32(data[3]) << 24)
-		}
-
-		result = fmt.Sprintf("%d", num)
+		// signed little endian int8, int16 or int32
+		result = fmt.Sprintf("%d", littleEndianInt(data))
 		// compressed string
 	case 3:
 		clength, _, err := parser.readLength(save)
@@ -389,11 +563,12 @@ func stateMagic(parser *Parser) (state, error) {
 		return nil, ErrWrongSignature
 	}
 
-	if version > 9 {
+	if version > rdbMaxVersion {
 		return nil, ErrVersionUnsupported
 	}
 
 	parser.rdbVersion = version
+	parser.metadata.Version = version
 	parser.rdbVersion16bit = make([]byte, 2)
 	binary.LittleEndian.PutUint16(parser.rdbVersion16bit, uint16(version))
 
@@ -402,7 +577,7 @@ func stateMagic(parser *Parser) (state, error) {
 
 // main selector of operations
 func stateOp(parser *Parser) (state, error) {
-	op, err := parser.reader.ReadByte()
+	op, err := parser.readByte()
 	if err != nil {
 		return nil, err
 	}
@@ -410,7 +585,9 @@ func stateOp(parser *Parser) (state, error) {
 	parser.currentOp = op
 
 	if parser.currentOp != rdbOpDB && parser.currentOp != rdbOpExpirySec && parser.currentOp != rdbOpExpiryMSec &&
-		parser.currentOp != rdbOpAux && parser.currentOp != rdbOpResizeDB {
+		parser.currentOp != rdbOpAux && parser.currentOp != rdbOpResizeDB &&
+		parser.currentOp != rdbOpFunction2 && parser.currentOp != rdbOpFunctionPreGA &&
+		parser.currentOp != rdbOpIdle && parser.currentOp != rdbOpFreq && parser.currentOp != rdbOpSlotInfo {
 		parser.commandWrite(true, []byte{op})
 	}
 
@@ -421,7 +598,12 @@ func stateOp(parser *Parser) (state, error) {
 		return stateExpirySec, nil
 	case rdbOpExpiryMSec:
 		return stateExpiryMSec, nil
-	case rdbOpString, rdbOpZipmap, rdbOpIntset, rdbOpZiplist, rdbOpSortedSet, rdbOpHashmap:
+	case rdbOpIdle:
+		return stateIdle, nil
+	case rdbOpFreq:
+		return stateFreq, nil
+	case rdbOpString, rdbOpZipmap, rdbOpIntset, rdbOpZiplist, rdbOpSortedSet, rdbOpHashmap,
+		rdbOpHashListpack, rdbOpZsetListpack, rdbOpSetListpack:
 		parser.valueState = stateCopyString
 		return stateKey, nil
 	case rdbOpList, rdbOpSet:
@@ -436,6 +618,12 @@ func stateOp(parser *Parser) (state, error) {
 	case rdbOpHash:
 		parser.valueState = stateCopyHash
 		return stateKey, nil
+	case rdbOpHashMetadata, rdbOpHashMetadataPreGA:
+		parser.valueState = stateCopyHashMetadata
+		return stateKey, nil
+	case rdbOpHashListpackEx, rdbOpHashListpackExPreGA:
+		parser.valueState = stateCopyHashListpackEx
+		return stateKey, nil
 	case rdbOpModule2:
 		parser.valueState = stateCopyModule2
 		return stateKey, nil
@@ -443,10 +631,19 @@ func stateOp(parser *Parser) (state, error) {
 		return stateAux, nil
 	case rdbOpResizeDB:
 		return stateResizeDB, nil
+	case rdbOpSlotInfo:
+		return stateSlotInfo, nil
+	case rdbOpFunction2:
+		return stateFunction2, nil
+	case rdbOpFunctionPreGA:
+		return stateFunctionPreGA, nil
 	case rdbOpListQuicklist:
 		parser.valueState = stateCopyQuicklist
 		return stateKey, nil
-	case rdbOpStreamListpacks:
+	case rdbOpListQuicklist2:
+		parser.valueState = stateCopyQuicklist2
+		return stateKey, nil
+	case rdbOpStreamListpacks, rdbOpStreamListpacks2, rdbOpStreamListpacks3:
 		parser.valueState = stateCopyListpacks
 		return stateKey, nil
 	case rdbOpEOF:
@@ -469,10 +666,54 @@ func stateResizeDB(parser *Parser) (state, error) {
 	if err != nil {
 		return nil, err
 	}
-	nouse(dbSize, expireSize)
-	// pp.Printf("dbsize %s expireSize %s\n", int(dbSize), int(expireSize))
+	info := parser.metadata.db(parser.db)
+	info.ResizeKeys, info.ResizeExpires = dbSize, expireSize
+	return stateOp, nil
+
+}
+
+// slot id, number of keys and number of expires of slot whose keys follow, written by cluster nodes since redis 7.4
+func stateSlotInfo(parser *Parser) (state, error) {
+	slot, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+	size, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+
+	parser.checkSlotSize()
+	parser.slot = int(slot)
+	parser.slotSize = size
+	parser.slotKeys = 0
+	parser.metadata.Slots++
 	return stateOp, nil
+}
+
+// key must belong to slot of last slot info, otherwise dump has keys its node doesn't own
+func (parser *Parser) checkSlot() {
+	parser.slotKeys++
+
+	slot := KeyHashSlot(parser.key)
+	if slot == parser.slot {
+		return
+	}
+	parser.metadata.SlotErrors++
+	if parser.metadata.SlotErrors <= rdbMaxReportedSlotErrors {
+		fmt.Fprintf(os.Stderr, "rdb: key %q of slot %d follows slot info of slot %d\n", parser.key, slot, parser.slot)
+	}
+}
 
+// number of keys of slot must match slot info
+func (parser *Parser) checkSlotSize() {
+	if parser.slot >= 0 && parser.slotKeys != parser.slotSize {
+		fmt.Fprintf(os.Stderr, "rdb: slot %d announces %d keys, %d found\n", parser.slot, parser.slotSize, parser.slotKeys)
+	}
 }
 
 func stateAux(parser *Parser) (state, error) {
@@ -485,18 +726,26 @@ func stateAux(parser *Parser) (state, error) {
 	if err != nil {
 		return nil, err
 	}
-	// pp.Println(key, value)
+	parser.metadata.setAux(key, value)
 
-	nouse(key, value)
+	// script cache of redis before 7, EVALSHA works only after SCRIPT LOAD on every node, replicas get it in their RDB
+	if key == "lua" && parser.entries != nil {
+		aux := append([]byte{rdbOpAux}, encodeLength(uint64(len(key)))...)
+		aux = append(append(aux, key...), encodeLength(uint64(len(value)))...)
+		parser.entries <- &RDBEntry{Function: true, Value: append(aux, value...)}
+	} else if key == "lua" {
+		parser.sendAll(&RedisCommand{Command: []string{"SCRIPT", "LOAD", value}})
+	}
 	return stateOp, nil
 }
 
 // DB index operation
 func stateDB(parser *Parser) (state, error) {
-	_, _, err := parser.readLength(false) // skip 0x00
+	db, _, err := parser.readLength(false)
 	if err != nil {
 		return nil, err
 	}
+	parser.db = int(db)
 
 	return stateOp, nil
 }
@@ -507,14 +756,14 @@ func stateExpirySec(parser *Parser) (state, error) {
 		return nil, err
 	}
 
-	fd := binary.LittleEndian.Uint64(expiry)
-
-	timeGap := fd - currentTimestamp
+	fd := uint64(binary.LittleEndian.Uint32(expiry))
+	parser.expireAt = fd * 1000
 
-	if timeGap < 0 {
+	now := atomic.LoadUint64(&currentTimestamp)
+	if fd <= now {
 		parser.expiry = 1
 	} else {
-		parser.expiry = timeGap * 1000
+		parser.expiry = (fd - now) * 1000
 	}
 
 	return stateOp, nil
@@ -527,9 +776,11 @@ func stateExpiryMSec(parser *Parser) (state, error) {
 	}
 
 	fc := binary.LittleEndian.Uint64(expiry)
-	timeGap := fc - currentTimestamp*1000
+	parser.expireAt = fc
+	now := atomic.LoadUint64(&currentTimestamp) * 1000
+	timeGap := fc - now
 
-	if fc < currentTimestamp*1000 {
+	if fc < now {
 		parser.expiry = 1
 	} else {
 		parser.expiry = timeGap
@@ -538,6 +789,30 @@ func stateExpiryMSec(parser *Parser) (state, error) {
 	return stateOp, nil
 }
 
+// LRU idle time of following key in seconds
+func stateIdle(parser *Parser) (state, error) {
+	idle, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+	parser.idle = idle
+	parser.hasIdle = true
+
+	return stateOp, nil
+}
+
+// LFU counter of following key
+func stateFreq(parser *Parser) (state, error) {
+	freq, err := parser.readByte()
+	if err != nil {
+		return nil, err
+	}
+	parser.freq = freq
+	parser.hasFreq = true
+
+	return stateOp, nil
+}
+
 // read key
 func stateKey(parser *Parser) (state, error) {
 	key, err := parser.readString(false)
@@ -557,7 +832,10 @@ func stateCopyString(parser *Parser) (state, error) {
 		return nil, err
 	}
 
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 
@@ -578,7 +856,10 @@ func stateCopySetOrList(parser *Parser) (state, error) {
 		}
 	}
 
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 
@@ -605,7 +886,76 @@ func stateCopyHash(parser *Parser) (state, error) {
 		}
 	}
 
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
+	return stateOp, nil
+}
+
+// skip over hash with field TTLs, GA version starts with min expiration of fields and stores TTLs relative to it
+func stateCopyHashMetadata(parser *Parser) (state, error) {
+	if parser.currentOp == rdbOpHashMetadata {
+		minExpire, err := parser.safeRead(8)
+		if err != nil {
+			return nil, err
+		}
+		parser.commandWrite(true, minExpire)
+	}
+
+	length, _, err := parser.readLength(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var i uint64
+
+	for i = 0; i < length; i++ {
+		// ttl, 0 when field doesn't expire
+		_, _, err = parser.readLength(true)
+		if err != nil {
+			return nil, err
+		}
+
+		// key
+		err = parser.copyString(true)
+		if err != nil {
+			return nil, err
+		}
+
+		// value
+		err = parser.copyString(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
+	return stateOp, nil
+}
+
+// skip over listpack of field, value, ttl triplets, GA version starts with min expiration of fields
+func stateCopyHashListpackEx(parser *Parser) (state, error) {
+	if parser.currentOp == rdbOpHashListpackEx {
+		minExpire, err := parser.safeRead(8)
+		if err != nil {
+			return nil, err
+		}
+		parser.commandWrite(true, minExpire)
+	}
+
+	err := parser.copyString(true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 
@@ -624,7 +974,7 @@ func stateCopyZset(parser *Parser) (state, error) {
 			return nil, err
 		}
 
-		dlen, err := parser.reader.ReadByte()
+		dlen, err := parser.readByte()
 		if err != nil {
 			return nil, err
 		}
@@ -639,7 +989,10 @@ func stateCopyZset(parser *Parser) (state, error) {
 		}
 	}
 
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 
@@ -658,16 +1011,18 @@ func stateCopyZset2(parser *Parser) (state, error) {
 			return nil, err
 		}
 
+		// score double
 		scoreBytes, err := parser.safeRead(uint64(8))
 		if err != nil {
 			return nil, err
 		}
-		// score double
-		score := math.Float64frombits(binary.LittleEndian.Uint64(scoreBytes))
-		nouse(score)
+		parser.commandWrite(true, scoreBytes)
 	}
 
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 func stateCopyQuicklist(parser *Parser) (state, error) {
@@ -683,19 +1038,209 @@ func stateCopyQuicklist(parser *Parser) (state, error) {
 		}
 
 	}
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
+	return stateOp, nil
+}
+
+// skip over quicklist (RDB 10+), every node is prefixed by its container type
+func stateCopyQuicklist2(parser *Parser) (state, error) {
+	nodes, _, err := parser.readLength(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < nodes; i++ {
+		container, _, err := parser.readLength(true)
+		if err != nil {
+			return nil, err
+		}
+		if container != quicklistNodePlain && container != quicklistNodePacked {
+			return nil, fmt.Errorf("rdb: unknown quicklist container %d", container)
+		}
+
+		// plain element or listpack
+		err = parser.copyString(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
+
+// skip over stream: listpacks, metadata and consumer groups with their PELs
 func stateCopyListpacks(parser *Parser) (state, error) {
-	return nil, errors.New("not imp")
+	listpacks, _, err := parser.readLength(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < listpacks; i++ {
+		// master entry ID
+		err = parser.copyString(true)
+		if err != nil {
+			return nil, err
+		}
+		// listpack
+		err = parser.copyString(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// length, last ID (ms, seq)
+	err = parser.copyLengths(3)
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.currentOp != rdbOpStreamListpacks {
+		// first ID (ms, seq), max deleted ID (ms, seq), entries added
+		err = parser.copyLengths(5)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups, _, err := parser.readLength(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < groups; i++ {
+		err = parser.copyStreamGroup()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
+	return stateOp, nil
+}
+
+// skip over stream consumer group
+func (parser *Parser) copyStreamGroup() error {
+	// name
+	err := parser.copyString(true)
+	if err != nil {
+		return err
+	}
+
+	// last ID (ms, seq)
+	err = parser.copyLengths(2)
+	if err != nil {
+		return err
+	}
+
+	if parser.currentOp != rdbOpStreamListpacks {
+		// entries read
+		err = parser.copyLengths(1)
+		if err != nil {
+			return err
+		}
+	}
+
+	// global PEL: raw ID, delivery time, delivery count
+	pending, _, err := parser.readLength(true)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < pending; i++ {
+		err = parser.copyRaw(streamIDSize + 8)
+		if err != nil {
+			return err
+		}
+		err = parser.copyLengths(1)
+		if err != nil {
+			return err
+		}
+	}
+
+	consumers, _, err := parser.readLength(true)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < consumers; i++ {
+		// name
+		err = parser.copyString(true)
+		if err != nil {
+			return err
+		}
+
+		// seen time, active time since RDB_TYPE_STREAM_LISTPACKS_3
+		if parser.currentOp == rdbOpStreamListpacks3 {
+			err = parser.copyRaw(16)
+		} else {
+			err = parser.copyRaw(8)
+		}
+		if err != nil {
+			return err
+		}
+
+		// consumer PEL, raw IDs only
+		pending, _, err := parser.readLength(true)
+		if err != nil {
+			return err
+		}
+		err = parser.copyRaw(pending * streamIDSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copy n length encoded numbers
+func (parser *Parser) copyLengths(n int) error {
+	for i := 0; i < n; i++ {
+		_, _, err := parser.readLength(true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy n raw bytes
+func (parser *Parser) copyRaw(n uint64) error {
+	data, err := parser.safeRead(n)
+	if err != nil {
+		return err
+	}
+	parser.commandWrite(true, data)
+	return nil
 }
 
 // re-calculate crc64
 func stateCRC64(parser *Parser) (state, error) {
-	_, err := parser.safeRead(8)
+	expected := parser.hash
+
+	data, err := parser.safeRead(8)
 	if err != nil {
 		return nil, err
 	}
+
+	// zero checksum is written with rdbchecksum no
+	checksum := binary.LittleEndian.Uint64(data)
+	if checksum == 0 {
+		fmt.Fprintf(os.Stderr, "rdb: checksum disabled, not verified\n")
+		return statePadding, nil
+	}
+	if checksum != expected {
+		return nil, fmt.Errorf("%w: %016x in file, %016x calculated", ErrChecksum, checksum, expected)
+	}
 	return statePadding, nil
 }
 
@@ -781,46 +1326,45 @@ func stateCopyModule2(parser *Parser) (state, error) {
 		return nil, err
 	}
 
-	// todo 改成 switch
-	if length == 3465209449566631940 {
-		// bloomFilter
-		return stateCopyBloomFilter(parser)
-	} else if length == 3465209449562641412 {
-		// cuckooFilter
-		return stateCopyCuckooFilter(parser)
-	} else if length == 5659418315958718464 {
-		return stateCopyTopk(parser)
-	} else if length == 5490471757281169408 {
-		return stateCopyTDigest(parser)
-	} else if length == 631811237999480832 {
-		return stateCopyCMS(parser)
-	} else {
-		fmt.Println(length)
-		return nil, errors.New("目前只支持布隆过滤器模块")
-	}
+	name, encver := moduleTypeName(length)
+	parser.metadata.Modules[fmt.Sprintf("%s v%d", name, encver)]++
 
+	// module without handler is copied opcode by opcode, it fails only for malformed value
+	handler := moduleHandler(name, encver)
+	if handler == nil {
+		err = copyModuleOpcodes(parser)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s v%d, register ModuleHandler for it: %s", ErrUnknownModule, name, encver, err)
+		}
+		return stateRdbModuleEOF(parser)
+	}
+	err = handler.Copy(parser)
+	if err != nil {
+		return nil, fmt.Errorf("rdb: module %s v%d: %w", name, encver, err)
+	}
+	return stateRdbModuleEOF(parser)
 }
 
-func stateCopyBloomFilter(parser *Parser) (state, error) {
+func copyBloomFilter(parser *Parser) error {
 	// size
 	_, err := parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// nfilters
 	nfilters, err := parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// options
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// growth
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	numFilters := int(nfilters)
@@ -832,87 +1376,87 @@ func stateCopyBloomFilter(parser *Parser) (state, error) {
 		// entries
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// error
 		_, err = parser.readDouble(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// hashes
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// bpe
 		_, err = parser.readDouble(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// bits
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// n2
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// string buffer
 		_, err = parser.readStringBuffer(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// size
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 	}
 
-	return stateRdbModuleEOF(parser)
+	return nil
 }
 
-func stateCopyCuckooFilter(parser *Parser) (state, error) {
+func copyCuckooFilter(parser *Parser) error {
 	numFilters, err := parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// numBuckets
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// numItems
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// numDeletes
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// bucketSize
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// maxIterations
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// expansion
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	i := uint64(0)
@@ -922,50 +1466,50 @@ func stateCopyCuckooFilter(parser *Parser) (state, error) {
 		// filters[i].numBuckets
 		_, err = parser.readUnsigned(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// string buffer
 		_, err = parser.readStringBuffer(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 	}
 
-	return stateRdbModuleEOF(parser)
+	return nil
 }
 
-func stateCopyTopk(parser *Parser) (state, error) {
+func copyTopk(parser *Parser) error {
 	// k
 	k, err := parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	//  width
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	//  depth
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// decay
 	_, err = parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// Bucket
 	_, err = parser.readStringBuffer(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// HeapBucket
 	_, err = parser.readStringBuffer(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	i := uint64(0)
@@ -975,103 +1519,103 @@ func stateCopyTopk(parser *Parser) (state, error) {
 		// k
 		_, err = parser.readStringBuffer(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 	}
 
-	return stateRdbModuleEOF(parser)
+	return nil
 }
 
-func stateCopyTDigest(parser *Parser) (state, error) {
+func copyTDigest(parser *Parser) error {
 	// compression
 	_, err := parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// min
 	_, err = parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// max
 	_, err = parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// cap
 	_, err = parser.readSigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	//  merged_nodes
 	mergedNodes, err := parser.readSigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	} else if int64(mergedNodes) < 0 {
-		return nil, errors.New("mergedNodes 大于 int64 表示的整数范围")
+		return errors.New("mergedNodes 大于 int64 表示的整数范围")
 	}
 	// unmerged_nodes
 	_, err = parser.readSigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// total_compressions
 	_, err = parser.readSigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	//  merged_weight
 	_, err = parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// unmerged_weight
 	_, err = parser.readDouble(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// mean
 	for i := int64(0); i < int64(mergedNodes); i++ {
 		_, err = parser.readDouble(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 	// count
 	for i := int64(0); i < int64(mergedNodes); i++ {
 		_, err = parser.readDouble(true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return stateRdbModuleEOF(parser)
+	return nil
 }
 
-func stateCopyCMS(parser *Parser) (state, error) {
+func copyCMS(parser *Parser) error {
 	// width
 	_, err := parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// depth
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// counter
 	_, err = parser.readUnsigned(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// data
 	_, err = parser.readStringBuffer(true)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return stateRdbModuleEOF(parser)
+	return nil
 }
 
 func stateRdbModuleEOF(parser *Parser) (state, error) {
@@ -1081,10 +1625,104 @@ func stateRdbModuleEOF(parser *Parser) (state, error) {
 	} else if eof != RdbModuleOpcodeEOF {
 		return nil, errors.New(fmt.Sprintf("illegal RdbModuleOpcodeString %d,expect:%d", eof, RdbModuleOpcodeEOF))
 	}
-	parser.keep()
+	err = parser.keep()
+	if err != nil {
+		return nil, err
+	}
 	return stateOp, nil
 }
 
 func nouse(i ...interface{}) {
 
 }
+
+// function library of redis 7, code starts with shebang naming library
+func stateFunction2(parser *Parser) (state, error) {
+	code, err := parser.readString(false)
+	if err != nil {
+		return nil, err
+	}
+	parser.metadata.Functions = append(parser.metadata.Functions, functionLibraryName(code))
+
+	// replicas get library in their RDB
+	if parser.entries != nil {
+		value := append([]byte{rdbOpFunction2}, encodeLength(uint64(len(code)))...)
+		parser.entries <- &RDBEntry{Function: true, Value: append(value, code...)}
+		return stateOp, nil
+	}
+
+	if Native {
+		cmd := []string{"FUNCTION", "LOAD", code}
+		if Replace {
+			cmd = []string{"FUNCTION", "LOAD", "REPLACE", code}
+		}
+		parser.sendAll(&RedisCommand{Command: cmd})
+		return stateOp, nil
+	}
+
+	// payload of FUNCTION DUMP: opcode and code followed by RDB version and CRC64 as in DUMP
+	payload := append([]byte{rdbOpFunction2}, encodeLength(uint64(len(code)))...)
+	payload = append(payload, code...)
+	payload = append(payload, parser.rdbVersion16bit...)
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, CRC64Update(0, payload))
+	payload = append(payload, crc...)
+
+	policy := "APPEND"
+	if Replace {
+		policy = "REPLACE"
+	}
+	parser.sendAll(&RedisCommand{Command: []string{"FUNCTION", "RESTORE", string(payload), policy}})
+	return stateOp, nil
+}
+
+// function of redis 7.0 release candidates, redis itself refuses to load it
+func stateFunctionPreGA(parser *Parser) (state, error) {
+	name, err := parser.readString(false)
+	if err != nil {
+		return nil, err
+	}
+	// engine
+	err = parser.copyString(false)
+	if err != nil {
+		return nil, err
+	}
+	hasDesc, _, err := parser.readLength(false)
+	if err != nil {
+		return nil, err
+	}
+	if hasDesc != 0 {
+		err = parser.copyString(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// code
+	err = parser.copyString(false)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "rdb: function %s has pre-release format of redis 7.0, skipped\n", name)
+	return stateOp, nil
+}
+
+// name of function library from its shebang: #!lua name=mylib
+func functionLibraryName(code string) string {
+	line, _, _ := strings.Cut(code, "\n")
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, "name=") {
+			return strings.TrimPrefix(field, "name=")
+		}
+	}
+	return ""
+}
+
+// send command without key to every node, it isn't counted in byte budget
+func (parser *Parser) sendAll(cmd *RedisCommand) {
+	if parser.output == nil || SkipRDB {
+		return
+	}
+	cmd.AllNodes = true
+	parser.output <- cmd
+}
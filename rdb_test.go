@@ -1,12 +1,8 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"io"
-	"os"
 	"testing"
 )
 
@@ -14,12 +10,11 @@ func coreTest(t *testing.T, path string) {
 	ch1 := make(chan *RedisCommand, 10)
 	chs := []chan *RedisCommand{ch1}
 	var xxx uint64
-	var result string
-	if fileObj, err := os.Open(path); err == nil {
-		defer fileObj.Close()
-		contents, _ := io.ReadAll(fileObj)
-		result = string(contents)
+	fileObj, err := openInput(path)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer fileObj.Close()
 
 	conn, err := getConn("127.0.0.1:6379", "123")
 	if err != nil {
@@ -32,11 +27,9 @@ func coreTest(t *testing.T, path string) {
 		}
 	}(conn)
 
+	errs := make(chan error, 1)
 	go func() {
-		err := ParseRDB(bufio.NewReader(bytes.NewBufferString(result)), chs[0], &xxx)
-		if err != nil {
-			t.Fatal(err)
-		}
+		errs <- ParseRDB(fileObj.Reader, chs[0], &xxx)
 		close(ch1)
 	}()
 
@@ -67,6 +60,10 @@ func coreTest(t *testing.T, path string) {
 
 	}
 
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
 	fmt.Println("success pass:" + path)
 }
 
@@ -221,3 +218,28 @@ func Test_cms(t *testing.T) {
 	path := "./cases/cms.rdb"
 	coreTest(t, path)
 }
+
+func Test_listpack(t *testing.T) {
+	path := "./cases/listpack.rdb"
+	coreTest(t, path)
+}
+
+func Test_set_listpack(t *testing.T) {
+	path := "./cases/set_listpack.rdb"
+	coreTest(t, path)
+}
+
+func Test_stream_listpacks_1(t *testing.T) {
+	path := "./cases/stream_listpacks_1.rdb"
+	coreTest(t, path)
+}
+
+func Test_stream_listpacks_2(t *testing.T) {
+	path := "./cases/stream_listpacks_2.rdb"
+	coreTest(t, path)
+}
+
+func Test_stream_listpacks_3(t *testing.T) {
+	path := "./cases/stream_listpacks_3.rdb"
+	coreTest(t, path)
+}
@@ -0,0 +1,155 @@
+package main
+
+// RDB writer: builds RDB file of entries produced by ParseEntries, used to send filtered RDB to replicas
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RDBEntry is key with its value serialized as in RDB: type byte followed by encoded value
+type RDBEntry struct {
+	DB       int
+	Key      string
+	ExpireAt uint64
+	// LRU idle seconds and LFU counter, written only when set
+	Idle    uint64
+	Freq    byte
+	HasIdle bool
+	HasFreq bool
+	Value   []byte
+	// function library or lua script aux field, without key, Value is opcode and its data
+	Function bool
+}
+
+// RDBWriter writes RDB file, checksum is calculated on the fly
+type RDBWriter struct {
+	writer  io.Writer
+	version int
+	crc     uint64
+	db      int
+}
+
+// NewRDBWriter writes RDB header of version
+func NewRDBWriter(writer io.Writer, version int) (*RDBWriter, error) {
+	w := &RDBWriter{
+		writer:  writer,
+		version: version,
+		db:      -1,
+	}
+
+	err := w.write([]byte(fmt.Sprintf("REDIS%04d", version)))
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RDBWriter) write(data []byte) error {
+	w.crc = CRC64Update(w.crc, data)
+	_, err := w.writer.Write(data)
+	return err
+}
+
+// length encoding of RDB
+func encodeLength(length uint64) []byte {
+	var buf []byte
+
+	switch {
+	case length < 1<<6:
+		buf = []byte{byte(length)}
+	case length < 1<<14:
+		buf = []byte{byte(rdbLen14bit<<6 | length>>8), byte(length)}
+	case length <= 0xFFFFFFFF:
+		buf = make([]byte, 5)
+		buf[0] = Type32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	default:
+		buf = make([]byte, 9)
+		buf[0] = Type64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+	}
+	return buf
+}
+
+func (w *RDBWriter) writeLength(length uint64) error {
+	return w.write(encodeLength(length))
+}
+
+// plain string, without integer or LZF encoding
+func (w *RDBWriter) writeString(s string) error {
+	err := w.writeLength(uint64(len(s)))
+	if err != nil {
+		return err
+	}
+	return w.write([]byte(s))
+}
+
+// WriteEntry writes SELECTDB when database changes, expiry, idle time or frequency, type, key and value
+func (w *RDBWriter) WriteEntry(entry *RDBEntry) error {
+	if len(entry.Value) == 0 {
+		return fmt.Errorf("rdb: key %q has no value", entry.Key)
+	}
+	if entry.Function {
+		return w.write(entry.Value)
+	}
+
+	if entry.DB != w.db {
+		err := w.write([]byte{rdbOpDB})
+		if err != nil {
+			return err
+		}
+		err = w.writeLength(uint64(entry.DB))
+		if err != nil {
+			return err
+		}
+		w.db = entry.DB
+	}
+
+	if entry.ExpireAt > 0 {
+		buf := make([]byte, 9)
+		buf[0] = rdbOpExpiryMSec
+		binary.LittleEndian.PutUint64(buf[1:], entry.ExpireAt)
+		err := w.write(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if entry.HasIdle {
+		err := w.write(append([]byte{rdbOpIdle}, encodeLength(entry.Idle)...))
+		if err != nil {
+			return err
+		}
+	}
+	if entry.HasFreq {
+		err := w.write([]byte{rdbOpFreq, entry.Freq})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.write(entry.Value[:1])
+	if err != nil {
+		return err
+	}
+	err = w.writeString(entry.Key)
+	if err != nil {
+		return err
+	}
+	return w.write(entry.Value[1:])
+}
+
+// Close writes EOF opcode and checksum, RDB before version 5 has no checksum
+func (w *RDBWriter) Close() error {
+	err := w.write([]byte{rdbOpEOF})
+	if err != nil || w.version < 5 {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, w.crc)
+	_, err = w.writer.Write(buf)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func parseAllObjects(t *testing.T, rdb []byte) []RedisObject {
+	ch1 := make(chan RedisObject, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ParseObjects(bufio.NewReader(bytes.NewReader(rdb)), ch1)
+		close(ch1)
+	}()
+
+	var objects []RedisObject
+	for obj := range ch1 {
+		objects = append(objects, obj)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+// every case rewritten from entries decodes to the same objects
+func TestRDBWriter(t *testing.T) {
+	files, err := filepath.Glob("./cases/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range files {
+		path = path[:len(path)-len(".json")] + ".rdb"
+		rdb, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			version, err := strconv.Atoi(string(rdb[5:9]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			writer, err := NewRDBWriter(&buf, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ch1 := make(chan *RDBEntry, 10)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- ParseEntries(bufio.NewReader(bytes.NewReader(rdb)), ch1)
+				close(ch1)
+			}()
+			for entry := range ch1 {
+				if err := writer.WriteEntry(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if version >= 5 {
+				data := buf.Bytes()
+				sum := CRC64Update(0, data[:len(data)-8])
+				if sum != binary.LittleEndian.Uint64(data[len(data)-8:]) {
+					t.Errorf("checksum %x doesn't match", sum)
+				}
+			}
+
+			if got, want := parseAllObjects(t, buf.Bytes()), parseAllObjects(t, rdb); !reflect.DeepEqual(got, want) {
+				t.Errorf("rewritten RDB decodes to %d objects, expected %d", len(got), len(want))
+			}
+		})
+	}
+}
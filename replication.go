@@ -0,0 +1,435 @@
+package main
+
+// Replication source: connects to master as replica and parses RDB of full resync straight from socket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// diskless transfer is "$EOF:<mark>" followed by RDB and the same mark
+	replicationEOFPrefix = "EOF:"
+	replicationMarkSize  = 40
+
+	// master drops replica which doesn't ACK for repl-timeout (60 seconds by default)
+	replicationAckInterval = time.Second
+)
+
+var (
+	// ErrBadEOFMark is returned when diskless RDB doesn't end with announced mark
+	ErrBadEOFMark = errors.New("replication: RDB isn't terminated by EOF mark")
+)
+
+// ReplicationSource is replica connection to master
+type ReplicationSource struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// ACKs are written from timer too
+	writeLock sync.Mutex
+
+	// replication id announced by FULLRESYNC, offset grows with every command read
+	ReplID string
+	Offset int64
+	// offset of last command passed to output
+	sent int64
+}
+
+// commands of stream offset waiting for reply
+type offsetCommands struct {
+	offset  int64
+	pending int
+}
+
+// OffsetTracker keeps commands of the stream passed to target until their reply, replies of parallel connections
+// come in any order, so offset is applied only when every command up to it is answered, nil tracker tracks nothing
+type OffsetTracker struct {
+	lock sync.Mutex
+	// offsets of commands waiting for reply in order they were sent
+	queue   []offsetCommands
+	waiting map[*RedisCommand]bool
+	// every command up to this offset is answered
+	applied int64
+}
+
+// offsets of -follow commands, set by main
+var appliedOffsets *OffsetTracker
+
+// NewOffsetTracker returns tracker without commands
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{waiting: map[*RedisCommand]bool{}}
+}
+
+// Sent adds command passed to target, commands of RDB have no offset
+func (t *OffsetTracker) Sent(cmd *RedisCommand) {
+	if t == nil || cmd.Offset == 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.waiting[cmd] {
+		return
+	}
+	t.waiting[cmd] = true
+	if n := len(t.queue); n > 0 && t.queue[n-1].offset == cmd.Offset {
+		t.queue[n-1].pending++
+		return
+	}
+	t.queue = append(t.queue, offsetCommands{offset: cmd.Offset, pending: 1})
+}
+
+// Done removes answered or dropped command, command written to every node is done with its first reply
+func (t *OffsetTracker) Done(cmd *RedisCommand) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.waiting[cmd] {
+		return
+	}
+	delete(t.waiting, cmd)
+	for i := range t.queue {
+		if t.queue[i].offset == cmd.Offset {
+			t.queue[i].pending--
+			break
+		}
+	}
+
+	// offsets before lowest one waiting for reply are applied
+	for len(t.queue) > 0 && t.queue[0].pending == 0 {
+		t.applied = t.queue[0].offset
+		t.queue = t.queue[1:]
+	}
+}
+
+// Applied returns offset up to which every command is answered
+func (t *OffsetTracker) Applied() int64 {
+	if t == nil {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.applied
+}
+
+// trackApplied is called with every reply of target
+func trackApplied(cmd *RedisCommand, replyErr error) {
+	appliedOffsets.Done(cmd)
+}
+
+// NewReplicationSource connects to master and requests full resync
+func NewReplicationSource(addr string, password string) (*ReplicationSource, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &ReplicationSource{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	err = source.handshake(password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// AUTH, REPLCONF and PSYNC ? -1
+func (s *ReplicationSource) handshake(password string) error {
+	if password != "" {
+		_, err := s.call("AUTH", password)
+		if err != nil {
+			return err
+		}
+	}
+
+	// eof allows diskless transfer, psync2 is required by redis >= 4 for PSYNC
+	_, err := s.call("REPLCONF", "capa", "eof", "capa", "psync2")
+	if err != nil {
+		return err
+	}
+
+	reply, err := s.call("PSYNC", "?", "-1")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		return fmt.Errorf("replication: unexpected PSYNC reply %q", reply)
+	}
+
+	s.ReplID = fields[1]
+	s.Offset, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("replication: unexpected PSYNC reply %q", reply)
+	}
+	return nil
+}
+
+// send command and read its status reply
+func (s *ReplicationSource) call(args ...string) (string, error) {
+	err := writeCommand(s.writer, args...)
+	if err != nil {
+		return "", err
+	}
+	err = s.writer.Flush()
+	if err != nil {
+		return "", err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("replication: %s failed: %s", args[0], line[1:])
+	}
+	if !strings.HasPrefix(line, "+") {
+		return "", fmt.Errorf("replication: unexpected %s reply %q", args[0], line)
+	}
+	return line[1:], nil
+}
+
+// read line skipping empty lines, master sends them as keepalive while preparing RDB
+func (s *ReplicationSource) readLine() (string, error) {
+	for {
+		line, err := readLine(s.reader)
+		if err != nil {
+			return "", err
+		}
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+// ParseRDB reads RDB bulk sent by master after FULLRESYNC and parses it to output
+func (s *ReplicationSource) ParseRDB(output chan *RedisCommand, counter *uint64) error {
+	return s.ReadRDB(func(reader *bufio.Reader) error {
+		return ParseRDB(reader, output, counter)
+	})
+}
+
+// ReadRDB passes RDB bulk sent by master after FULLRESYNC to parse, parse may stop at the end of RDB
+func (s *ReplicationSource) ReadRDB(parse func(reader *bufio.Reader) error) error {
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("replication: unexpected RDB header %q", line)
+	}
+
+	if strings.HasPrefix(line[1:], replicationEOFPrefix) {
+		mark := []byte(line[1+len(replicationEOFPrefix):])
+		if len(mark) != replicationMarkSize {
+			return fmt.Errorf("replication: unexpected RDB header %q", line)
+		}
+
+		// parser stops right after RDB, mark follows
+		err = parse(s.reader)
+		if err != nil {
+			return err
+		}
+
+		end := make([]byte, replicationMarkSize)
+		_, err = io.ReadFull(s.reader, end)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(end, mark) {
+			return ErrBadEOFMark
+		}
+		return nil
+	}
+
+	length, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || length < 0 {
+		return fmt.Errorf("replication: unexpected RDB header %q", line)
+	}
+
+	body := io.LimitReader(s.reader, length)
+	err = parse(bufio.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// whatever parser didn't need, command stream starts after it
+	_, err = io.Copy(io.Discard, body)
+	return err
+}
+
+// Follow sends write commands propagated by master after RDB to output until connection fails
+func (s *ReplicationSource) Follow(output chan *RedisCommand) error {
+	stream := NewCommandStream()
+	stream.applied = true
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.ackLoop(done)
+
+	for {
+		args, size, err := readCommand(s.reader)
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 3 && strings.EqualFold(args[0], "REPLCONF") && strings.EqualFold(args[1], "GETACK") {
+			err = s.ack()
+		} else {
+			stream.offset = atomic.LoadInt64(&s.Offset) + size
+			err = stream.Process(args, output)
+			atomic.StoreInt64(&s.sent, stream.sent)
+		}
+		if err != nil {
+			return err
+		}
+
+		atomic.AddInt64(&s.Offset, size)
+	}
+}
+
+// REPLCONF ACK with offset of commands applied on target
+func (s *ReplicationSource) ack() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	err := writeCommand(s.writer, "REPLCONF", "ACK", strconv.FormatInt(s.applied(), 10))
+	if err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func (s *ReplicationSource) ackLoop(done chan struct{}) {
+	ticker := time.NewTicker(replicationAckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if s.ack() != nil {
+				return
+			}
+		}
+	}
+}
+
+// print how far behind master we are every interval
+func (s *ReplicationSource) reportLag(addr string, password string, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var conn redis.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if conn == nil {
+			conn, err = getConn(addr, password)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "sync: can't get master offset: %s\n", err)
+				continue
+			}
+		}
+
+		info, err := redis.String(conn.Do("INFO", "replication"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sync: can't get master offset: %s\n", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		offset := s.applied()
+		master, ok := infoField(info, "master_repl_offset")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "sync: offset %d\n", offset)
+			continue
+		}
+		masterOffset, _ := strconv.ParseInt(master, 10, 64)
+		fmt.Fprintf(os.Stderr, "sync: offset %d, master offset %d, lag %d bytes\n", offset, masterOffset, masterOffset-offset)
+	}
+}
+
+// offset written to target: of last command answered with every command before it, or of last command read when
+// every command passed to output got its reply and the rest of the stream had nothing to write
+func (s *ReplicationSource) applied() int64 {
+	applied := appliedOffsets.Applied()
+	if applied >= atomic.LoadInt64(&s.sent) {
+		return atomic.LoadInt64(&s.Offset)
+	}
+	return applied
+}
+
+// value of field in INFO reply
+func infoField(info string, name string) (string, bool) {
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, name+":") {
+			return line[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// Close closes connection to master
+func (s *ReplicationSource) Close() error {
+	return s.conn.Close()
+}
+
+// parse RDB of full resync with -master, then follow command stream with -follow
+func replicate(output chan *RedisCommand) error {
+	source, err := NewReplicationSource(Master, MasterPassword)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	err = source.ParseRDB(output, &counter)
+	if err != nil || !Follow {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if LagInterval > 0 {
+		go source.reportLag(Master, MasterPassword, LagInterval, done)
+	}
+	return source.Follow(output)
+}
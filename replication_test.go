@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplID = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+
+// master serving rdb and command stream to single replica, bulk is length prefixed or framed by EOF mark,
+// commands sent by replica after sync are passed to replies
+func fakeMaster(t *testing.T, rdb []byte, diskless bool, mark string, stream string, replies chan []string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		// AUTH, REPLCONF, PSYNC
+		for i := 0; i < 3; i++ {
+			header, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			var args []string
+			var n int
+			fmt.Sscanf(header, "*%d", &n)
+			for j := 0; j < n; j++ {
+				readLine(reader)
+				arg, _ := readLine(reader)
+				args = append(args, arg)
+			}
+
+			switch strings.ToUpper(args[0]) {
+			case "AUTH":
+				if args[1] != "secret" {
+					conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+					return
+				}
+				conn.Write([]byte("+OK\r\n"))
+			case "REPLCONF":
+				conn.Write([]byte("+OK\r\n"))
+			case "PSYNC":
+				fmt.Fprintf(conn, "+FULLRESYNC %s 42\r\n\n\n", testReplID)
+			}
+		}
+
+		if diskless {
+			fmt.Fprintf(conn, "$EOF:%s\r\n", testReplID)
+			conn.Write(rdb)
+			conn.Write([]byte(mark))
+		} else {
+			fmt.Fprintf(conn, "$%d\r\n", len(rdb))
+			conn.Write(rdb)
+		}
+
+		conn.Write([]byte(stream))
+
+		// replica closes connection when done
+		for {
+			args, _, err := readCommand(reader)
+			if err != nil {
+				return
+			}
+			if replies != nil {
+				replies <- args
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func parseCommands(t *testing.T, parse func(output chan *RedisCommand) error) ([][]string, error) {
+	ch1 := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- parse(ch1)
+		close(ch1)
+	}()
+
+	var cmds [][]string
+	for cmd := range ch1 {
+		cmds = append(cmds, cmd.Command)
+	}
+	return cmds, <-errs
+}
+
+func TestReplicationSource(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := parseCommands(t, func(output chan *RedisCommand) error {
+		return ParseRDB(bufio.NewReader(bytes.NewReader(rdb)), output, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, diskless := range []bool{false, true} {
+		addr := fakeMaster(t, rdb, diskless, testReplID, "", nil)
+
+		source, err := NewReplicationSource(addr, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source.ReplID != testReplID || source.Offset != 42 {
+			t.Errorf("FULLRESYNC parsed as %s %d", source.ReplID, source.Offset)
+		}
+
+		cmds, err := parseCommands(t, func(output chan *RedisCommand) error {
+			return source.ParseRDB(output, nil)
+		})
+		source.Close()
+		if err != nil {
+			t.Fatalf("diskless %v: %s", diskless, err)
+		}
+		if !reflect.DeepEqual(cmds, expected) {
+			t.Errorf("diskless %v: got %d commands, expected %d", diskless, len(cmds), len(expected))
+		}
+	}
+}
+
+func TestReplicationSourceErrors(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/memory.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewReplicationSource(fakeMaster(t, rdb, false, "", "", nil), "wrong"); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+
+	source, err := NewReplicationSource(fakeMaster(t, rdb, true, strings.Repeat("x", replicationMarkSize), "", nil), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	_, err = parseCommands(t, func(output chan *RedisCommand) error {
+		return source.ParseRDB(output, nil)
+	})
+	if err != ErrBadEOFMark {
+		t.Errorf("bad EOF mark gives %v", err)
+	}
+}
+
+func TestReplicationFollow(t *testing.T) {
+	rdb, err := os.ReadFile("./cases/empty_database.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	var offsets []int64
+	for _, args := range [][]string{
+		{"SELECT", "1"},
+		{"SET", "foo", "bar"},
+		{"MULTI"},
+		{"DEL", "a", "b"},
+		{"PEXPIREAT", "foo", "1700000000000"},
+		{"EXEC"},
+		{"PING"},
+		{"REPLCONF", "GETACK", "*"},
+	} {
+		writer := bufio.NewWriter(&stream)
+		writeCommand(writer, args...)
+		writer.Flush()
+		offsets = append(offsets, 42+int64(stream.Len()))
+	}
+
+	replies := make(chan []string, 10)
+	source, err := NewReplicationSource(fakeMaster(t, rdb, true, testReplID, stream.String(), replies), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	defer func(applied *OffsetTracker) { appliedOffsets = applied }(appliedOffsets)
+	appliedOffsets = NewOffsetTracker()
+
+	output := make(chan *RedisCommand, 10)
+	errs := make(chan error, 1)
+	go func() {
+		err := source.ParseRDB(output, nil)
+		if err == nil {
+			err = source.Follow(output)
+		}
+		errs <- err
+	}()
+
+	var cmds []string
+	var sent []*RedisCommand
+	for i := 0; i < 4; i++ {
+		cmd := <-output
+		if cmd.DB != 1 {
+			t.Errorf("%v is in db %d", cmd.Command, cmd.DB)
+		}
+		cmds = append(cmds, strings.Join(cmd.Command, " "))
+		sent = append(sent, cmd)
+	}
+	expected := []string{"SET foo bar", "DEL a", "DEL b", "PEXPIREAT foo 1700000000000"}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("stream forwarded as %q, expected %q", cmds, expected)
+	}
+	// commands of transaction have offset of EXEC
+	for i, offset := range []int64{offsets[1], offsets[5], offsets[5], offsets[5]} {
+		if sent[i].Offset != offset {
+			t.Errorf("%q has offset %d, expected %d", sent[i].Command, sent[i].Offset, offset)
+		}
+	}
+
+	// lag counts commands until their reply, the rest of the stream once every command is answered
+	for _, cmd := range sent {
+		appliedOffsets.Sent(cmd)
+	}
+	if applied := source.applied(); applied != 0 {
+		t.Errorf("applied %d before replies", applied)
+	}
+	trackApplied(sent[0], nil)
+	trackApplied(sent[3], nil)
+	// DEL of transaction still waits for reply
+	if applied := source.applied(); applied != offsets[1] {
+		t.Errorf("applied %d, expected %d", applied, offsets[1])
+	}
+
+	// ACK reports applied offset, earlier ACKs may come first
+	timeout := time.After(5 * time.Second)
+	for acked := false; !acked; {
+		select {
+		case ack := <-replies:
+			if len(ack) != 3 || ack[0] != "REPLCONF" || ack[1] != "ACK" {
+				t.Fatalf("unexpected reply %q", ack)
+			}
+			acked = ack[2] == fmt.Sprint(offsets[1])
+		case <-timeout:
+			t.Fatalf("no ACK with offset %d", offsets[1])
+		}
+	}
+
+	trackApplied(sent[1], nil)
+	trackApplied(sent[2], nil)
+	if applied := source.applied(); applied != offsets[len(offsets)-1] {
+		t.Errorf("applied %d, expected %d", applied, offsets[len(offsets)-1])
+	}
+
+	source.Close()
+	if err := <-errs; err == nil {
+		t.Errorf("closed connection isn't reported")
+	}
+}
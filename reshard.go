@@ -0,0 +1,356 @@
+package main
+
+// Resharding planner: only keys whose owner differs between old and new topology are written
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNoNewTopology is returned when resharding target can't tell owner of key
+	ErrNoNewTopology = errors.New("reshard: new topology is unknown, use -nutcracker-conf or -cluster")
+	// ErrRandomDistribution is returned for pools where key has no fixed owner
+	ErrRandomDistribution = errors.New("reshard: random distribution has no fixed key owner")
+	// ErrNoOldTopology is returned when -plan or -delete-moved is given without old topology
+	ErrNoOldTopology = errors.New("reshard: -plan and -delete-moved need -old-nutcracker-conf")
+)
+
+// Router tells which node owns key in some topology
+type Router interface {
+	Owner(key string) string
+}
+
+// Owner returns address of backend server of key
+func (pool *TwemproxyPool) Owner(key string) string {
+	return pool.Server(key).Addr
+}
+
+// Owner returns address of backend server of key
+func (t *TwemproxyTarget) Owner(key string) string {
+	return t.pool.Owner(key)
+}
+
+// Owner returns address of master serving slot of key
+func (t *ClusterTarget) Owner(key string) string {
+	return t.slots[KeyHashSlot(key)]
+}
+
+// keys and bytes going to single destination
+type planEntry struct {
+	keys  int64
+	bytes int64
+}
+
+// ReshardTarget passes to target only commands of keys moving to other node
+type ReshardTarget struct {
+	from     Router
+	to       Router
+	target   Target
+	planOnly bool
+
+	// old topology, gets DEL of moved keys after migration, only keys whose every reply was OK are deleted
+	cleanup   Target
+	movedLock sync.Mutex
+	movedKeys map[string]bool
+	// moved keys of multi-key commands waiting for reply, their other keys stay
+	multiKeys map[*RedisCommand][]string
+
+	// keys counted in plan, keys of command streams and logs come back after other keys
+	routed map[string]bool
+	// last routed key, commands of RDB key come one after another
+	started bool
+	key     string
+	moved   bool
+	entry   *planEntry
+
+	plan map[string]*planEntry
+	kept planEntry
+
+	// resolved ip:port of addresses, same server may be named by host in one topology and by ip in other
+	endpointsLock sync.Mutex
+	endpoints     map[string][]string
+}
+
+// NewReshardTarget wraps target writing to new topology, cleanup may be nil, planOnly writes nothing
+func NewReshardTarget(from Router, to Router, target Target, cleanup Target, planOnly bool) *ReshardTarget {
+	t := &ReshardTarget{
+		from:      from,
+		to:        to,
+		target:    target,
+		cleanup:   cleanup,
+		planOnly:  planOnly,
+		movedKeys: map[string]bool{},
+		multiKeys: map[*RedisCommand][]string{},
+		plan:      map[string]*planEntry{},
+		routed:    map[string]bool{},
+		endpoints: map[string][]string{},
+	}
+	if cleanup != nil && !planOnly {
+		target.Stats().onReply(t.replied)
+	}
+	return t
+}
+
+// key is moved when all its commands succeeded, single failure keeps it on old owner
+func (t *ReshardTarget) replied(cmd *RedisCommand, replyErr error) {
+	if cmd.Key == "" {
+		return
+	}
+
+	t.movedLock.Lock()
+	defer t.movedLock.Unlock()
+
+	keys := []string{cmd.Key}
+	if moved, ok := t.multiKeys[cmd]; ok {
+		keys = moved
+		delete(t.multiKeys, cmd)
+	}
+	for _, key := range keys {
+		if replyErr != nil {
+			t.movedKeys[key] = false
+		} else if _, ok := t.movedKeys[key]; !ok {
+			t.movedKeys[key] = true
+		}
+	}
+}
+
+// Send writes command when its key changes owner, multi-key command when any of its keys does
+func (t *ReshardTarget) Send(cmd *RedisCommand) error {
+	if len(cmd.Keys) > 1 {
+		t.routeAll(cmd)
+	} else if !t.started || cmd.Key != t.key {
+		t.started = true
+		t.key = cmd.Key
+		t.entry, t.moved = t.route(cmd.Key)
+	}
+
+	for _, arg := range cmd.Command {
+		t.entry.bytes += int64(len(arg))
+	}
+
+	if !t.moved || t.planOnly {
+		// not sent, no reply will release it
+		sendBudget.Release(cmd.BulkSize)
+		appliedOffsets.Done(cmd)
+		return nil
+	}
+	return t.target.Send(cmd)
+}
+
+// SendAll forwards command without key to new layout
+func (t *ReshardTarget) SendAll(cmd *RedisCommand) error {
+	if t.planOnly {
+		appliedOffsets.Done(cmd)
+		return nil
+	}
+	return t.target.SendAll(cmd)
+}
+
+// compare owners of key and account it in plan the first time it is seen
+func (t *ReshardTarget) route(key string) (*planEntry, bool) {
+	counted := t.routed[key]
+	t.routed[key] = true
+
+	to := t.to.Owner(key)
+	if t.sameEndpoint(t.from.Owner(key), to) {
+		if !counted {
+			t.kept.keys++
+		}
+		return &t.kept, false
+	}
+
+	entry := t.plan[to]
+	if entry == nil {
+		entry = &planEntry{}
+		t.plan[to] = entry
+	}
+	if !counted {
+		entry.keys++
+	}
+	return entry, true
+}
+
+// every key of multi-key command is accounted in plan, bytes go to destination of first moved key
+func (t *ReshardTarget) routeAll(cmd *RedisCommand) {
+	t.started = false
+	t.entry, t.moved = &t.kept, false
+
+	var moved []string
+	for _, key := range cmd.Keys {
+		entry, ok := t.route(key)
+		if ok && !t.moved {
+			t.entry, t.moved = entry, true
+		}
+		if ok {
+			moved = append(moved, key)
+		}
+	}
+
+	if t.moved && t.cleanup != nil && !t.planOnly {
+		t.movedLock.Lock()
+		t.multiKeys[cmd] = moved
+		t.movedLock.Unlock()
+	}
+}
+
+// sameEndpoint tells whether addresses resolve to the same ip and port
+func (t *ReshardTarget) sameEndpoint(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	for _, x := range t.resolve(a) {
+		for _, y := range t.resolve(b) {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ip:port of every address of host, address itself when it can't be resolved
+func (t *ReshardTarget) resolve(addr string) []string {
+	t.endpointsLock.Lock()
+	defer t.endpointsLock.Unlock()
+
+	if endpoints, ok := t.endpoints[addr]; ok {
+		return endpoints
+	}
+
+	endpoints := []string{addr}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		ips, err := net.LookupHost(host)
+		if err == nil && len(ips) > 0 {
+			endpoints = endpoints[:0]
+			for _, ip := range ips {
+				if parsed := net.ParseIP(ip); parsed != nil {
+					ip = parsed.String()
+				}
+				endpoints = append(endpoints, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+	t.endpoints[addr] = endpoints
+	return endpoints
+}
+
+// Flush writes queued commands of moved keys
+func (t *ReshardTarget) Flush() error {
+	return t.target.Flush()
+}
+
+// Close finishes migration, deletes moved keys from old owners and prints plan,
+// nothing is deleted when any command failed
+func (t *ReshardTarget) Close() error {
+	err := t.target.Close()
+	if err != nil {
+		return err
+	}
+
+	if t.cleanup != nil {
+		err = t.deleteMoved()
+		if err != nil {
+			return err
+		}
+	}
+
+	t.printPlan()
+	return nil
+}
+
+// delete keys written to new owner from old owner
+func (t *ReshardTarget) deleteMoved() error {
+	if failed := t.target.Stats().Failed(); failed > 0 {
+		fmt.Fprintf(os.Stderr, "reshard: %d commands failed, moved keys are kept on old owners\n", failed)
+		return t.cleanup.Close()
+	}
+
+	t.movedLock.Lock()
+	keys := make([]string, 0, len(t.movedKeys))
+	for key, ok := range t.movedKeys {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	t.movedLock.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// key written onto its own old owner has its only copy there
+		if t.sameEndpoint(t.from.Owner(key), t.to.Owner(key)) {
+			continue
+		}
+		err := t.cleanup.Send(&RedisCommand{Command: []string{"DEL", key}, Key: key})
+		if err != nil {
+			return err
+		}
+	}
+	err := t.cleanup.Close()
+	if err != nil {
+		return err
+	}
+	t.target.Stats().merge(t.cleanup.Stats())
+	return nil
+}
+
+// Stats counts replies of moved keys and their deletion
+func (t *ReshardTarget) Stats() *SendStats {
+	return t.target.Stats()
+}
+
+func (t *ReshardTarget) printPlan() {
+	destinations := make([]string, 0, len(t.plan))
+	for addr := range t.plan {
+		destinations = append(destinations, addr)
+	}
+	sort.Strings(destinations)
+
+	var moved planEntry
+	fmt.Printf("%-32s %12s %16s\n", "destination", "keys", "bytes")
+	for _, addr := range destinations {
+		entry := t.plan[addr]
+		moved.keys += entry.keys
+		moved.bytes += entry.bytes
+		fmt.Printf("%-32s %12d %16d\n", addr, entry.keys, entry.bytes)
+	}
+	fmt.Printf("%-32s %12d %16d\n", "moved", moved.keys, moved.bytes)
+	fmt.Printf("%-32s %12d %16d\n", "unchanged", t.kept.keys, t.kept.bytes)
+}
+
+// wrap target into resharding planner when old topology is given
+func reshardTarget(target Target) (Target, error) {
+	if OldNutcrackerConf == "" {
+		if PlanOnly || DeleteMoved {
+			return nil, ErrNoOldTopology
+		}
+		return target, nil
+	}
+
+	to, ok := target.(Router)
+	if !ok {
+		return nil, ErrNoNewTopology
+	}
+	if pool, ok := target.(*TwemproxyTarget); ok && pool.pool.Distribution == "random" {
+		return nil, ErrRandomDistribution
+	}
+
+	old, err := LoadTwemproxyPool(OldNutcrackerConf, OldNutcrackerPool)
+	if err != nil {
+		return nil, err
+	}
+	if old.Distribution == "random" {
+		return nil, ErrRandomDistribution
+	}
+
+	var cleanup Target
+	if DeleteMoved {
+		cleanup = NewTwemproxyTarget(old, proxyPassword, Pipeline)
+	}
+	return NewReshardTarget(old, to, target, cleanup, PlanOnly), nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// target remembering commands, replies are OK unless fail returns error
+type recordTarget struct {
+	cmds   []*RedisCommand
+	closed bool
+	stats  *SendStats
+	fail   func(cmd *RedisCommand) error
+}
+
+func (t *recordTarget) Send(cmd *RedisCommand) error {
+	t.cmds = append(t.cmds, cmd)
+
+	var replyErr error
+	if t.fail != nil {
+		replyErr = t.fail(cmd)
+	}
+	t.Stats().record(cmd, replyErr)
+	return nil
+}
+
+func (t *recordTarget) SendAll(cmd *RedisCommand) error {
+	return t.Send(cmd)
+}
+
+func (t *recordTarget) Flush() error {
+	return nil
+}
+
+func (t *recordTarget) Stats() *SendStats {
+	if t.stats == nil {
+		t.stats = NewSendStats()
+	}
+	return t.stats
+}
+
+func (t *recordTarget) Close() error {
+	t.closed = true
+	return nil
+}
+
+func testPool(t *testing.T, addrs ...string) *TwemproxyPool {
+	var servers []*TwemproxyServer
+	for _, addr := range addrs {
+		servers = append(servers, &TwemproxyServer{Addr: addr, Name: addr, Weight: 1})
+	}
+	pool, err := NewTwemproxyPool("fnv1a_64", "", "ketama", servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestReshardTarget(t *testing.T) {
+	old := testPool(t, "10.0.0.1:6379", "10.0.0.2:6379")
+	next := testPool(t, "10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379")
+
+	target, cleanup := &recordTarget{}, &recordTarget{}
+	reshard := NewReshardTarget(old, next, target, cleanup, false)
+
+	moved := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if old.Owner(key) != next.Owner(key) {
+			moved[key] = true
+		}
+		// two commands of every key
+		for _, cmd := range []*RedisCommand{
+			{Command: []string{"RPUSH", key, "a"}, Key: key},
+			{Command: []string{"PEXPIREAT", key, "1"}, Key: key},
+		} {
+			if err := reshard.Send(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(moved) == 0 || len(moved) == 1000 {
+		t.Fatalf("%d keys of 1000 moved", len(moved))
+	}
+
+	if err := reshard.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !target.closed || !cleanup.closed {
+		t.Errorf("targets are not closed")
+	}
+
+	if len(target.cmds) != len(moved)*2 {
+		t.Errorf("%d commands sent for %d moved keys", len(target.cmds), len(moved))
+	}
+	for _, cmd := range target.cmds {
+		if !moved[cmd.Key] {
+			t.Errorf("key %q sent but its owner is the same", cmd.Key)
+		}
+		if next.Owner(cmd.Key) != "10.0.0.3:6379" {
+			t.Errorf("key %q moved between old servers", cmd.Key)
+		}
+	}
+
+	if len(cleanup.cmds) != len(moved) {
+		t.Errorf("%d keys deleted, %d moved", len(cleanup.cmds), len(moved))
+	}
+	for _, cmd := range cleanup.cmds {
+		if cmd.Command[0] != "DEL" || !moved[cmd.Key] {
+			t.Errorf("unexpected cleanup %v", cmd.Command)
+		}
+	}
+
+	entry := reshard.plan["10.0.0.3:6379"]
+	if entry == nil || entry.keys != int64(len(moved)) || reshard.kept.keys != int64(1000-len(moved)) {
+		t.Errorf("plan %v, kept %v, moved %d", entry, reshard.kept, len(moved))
+	}
+}
+
+func TestReshardPlanOnly(t *testing.T) {
+	old := testPool(t, "10.0.0.1:6379")
+	next := testPool(t, "10.0.0.2:6379")
+
+	target := &recordTarget{}
+	reshard := NewReshardTarget(old, next, target, nil, true)
+	if err := reshard.Send(&RedisCommand{Command: []string{"SET", "foo", "bar"}, Key: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reshard.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.cmds) != 0 {
+		t.Errorf("plan only mode sent %d commands", len(target.cmds))
+	}
+	if entry := reshard.plan["10.0.0.2:6379"]; entry == nil || entry.keys != 1 || entry.bytes != 9 {
+		t.Errorf("plan is %v", entry)
+	}
+}
+
+func TestReshardFailedRestore(t *testing.T) {
+	old := testPool(t, "10.0.0.1:6379")
+	next := testPool(t, "10.0.0.2:6379")
+
+	target, cleanup := &recordTarget{}, &recordTarget{}
+	target.fail = func(cmd *RedisCommand) error {
+		if cmd.Key == "busy" {
+			return redis.Error("BUSYKEY Target key name already exists.")
+		}
+		return nil
+	}
+	reshard := NewReshardTarget(old, next, target, cleanup, false)
+	for _, key := range []string{"foo", "busy", "bar"} {
+		if err := reshard.Send(&RedisCommand{Command: []string{"RESTORE", key, "0", "payload"}, Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reshard.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// old owner keeps every key, including the only copy of busy
+	if len(cleanup.cmds) != 0 || !cleanup.closed {
+		t.Errorf("cleanup %d commands, closed %v", len(cleanup.cmds), cleanup.closed)
+	}
+	if target.Stats().Failed() != 1 {
+		t.Errorf("%d failed", target.Stats().Failed())
+	}
+}
+
+func TestReshardMovedKeys(t *testing.T) {
+	old := testPool(t, "10.0.0.1:6379")
+	next := testPool(t, "10.0.0.2:6379")
+
+	reshard := NewReshardTarget(old, next, &recordTarget{}, &recordTarget{}, false)
+	reshard.replied(&RedisCommand{Key: "foo"}, nil)
+	reshard.replied(&RedisCommand{Key: "bar"}, redis.Error("OOM command not allowed"))
+	reshard.replied(&RedisCommand{Key: "bar"}, nil)
+	reshard.replied(&RedisCommand{Key: "zap"}, nil)
+	reshard.replied(&RedisCommand{Key: "zap"}, redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+
+	if !reflect.DeepEqual(reshard.movedKeys, map[string]bool{"foo": true, "bar": false, "zap": false}) {
+		t.Errorf("moved keys %v", reshard.movedKeys)
+	}
+}
+
+func TestReshardMultiKey(t *testing.T) {
+	old := testPool(t, "10.0.0.1:6379", "10.0.0.2:6379")
+	next := testPool(t, "10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379")
+
+	// first key stays, second moves
+	var kept, moved string
+	for i := 0; kept == "" || moved == ""; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if old.Owner(key) == next.Owner(key) {
+			kept = key
+		} else {
+			moved = key
+		}
+	}
+	other := kept + "x"
+	for old.Owner(other) != next.Owner(other) {
+		other += "x"
+	}
+
+	// MSET of stream is split per key, RENAME keeps its keys together, every key is counted once
+	output := make(chan *RedisCommand, 10)
+	stream := NewCommandStream()
+	for _, args := range [][]string{{"MSET", kept, "v", moved, "v"}, {"RENAME", kept, moved}, {"RENAME", kept, other}} {
+		if err := stream.Process(args, output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(output)
+
+	target, cleanup := &recordTarget{}, &recordTarget{}
+	reshard := NewReshardTarget(old, next, target, cleanup, false)
+	for cmd := range output {
+		if err := reshard.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reshard.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sent for the moving key, only that key is deleted from its old owner
+	var sent []string
+	for _, cmd := range target.cmds {
+		sent = append(sent, strings.Join(cmd.Command, " "))
+	}
+	if expected := []string{"MSET " + moved + " v", "RENAME " + kept + " " + moved}; !reflect.DeepEqual(sent, expected) {
+		t.Errorf("sent %q, expected %q", sent, expected)
+	}
+	if len(cleanup.cmds) != 1 || cleanup.cmds[0].Key != moved {
+		t.Errorf("cleanup %d commands", len(cleanup.cmds))
+	}
+	if entry := reshard.plan[next.Owner(moved)]; entry == nil || entry.keys != 1 || reshard.kept.keys != 2 {
+		t.Errorf("plan %v, kept %v", entry, reshard.kept)
+	}
+	if len(reshard.multiKeys) != 0 {
+		t.Errorf("%d commands still waiting", len(reshard.multiKeys))
+	}
+}
+
+func TestReshardNeedsOldTopology(t *testing.T) {
+	defer func(planOnly, deleteMoved bool) { PlanOnly, DeleteMoved = planOnly, deleteMoved }(PlanOnly, DeleteMoved)
+
+	for _, flags := range [][2]bool{{true, false}, {false, true}} {
+		PlanOnly, DeleteMoved = flags[0], flags[1]
+		if _, err := reshardTarget(&recordTarget{}); err != ErrNoOldTopology {
+			t.Errorf("plan %v, delete moved %v: %v", PlanOnly, DeleteMoved, err)
+		}
+	}
+}
+
+// every key owned by single address
+type addrRouter string
+
+func (r addrRouter) Owner(string) string {
+	return string(r)
+}
+
+func TestReshardSameEndpoint(t *testing.T) {
+	target, cleanup := &recordTarget{}, &recordTarget{}
+	reshard := NewReshardTarget(addrRouter("localhost:6379"), addrRouter("127.0.0.1:6379"), target, cleanup, false)
+	if err := reshard.Send(&RedisCommand{Command: []string{"SET", "foo", "bar"}, Key: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	// even acknowledged key of the same server is never deleted
+	reshard.replied(&RedisCommand{Key: "foo"}, nil)
+	if err := reshard.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.cmds) != 0 || len(cleanup.cmds) != 0 {
+		t.Errorf("%d commands sent, %d deleted", len(target.cmds), len(cleanup.cmds))
+	}
+	if reshard.kept.keys != 1 || len(reshard.plan) != 0 {
+		t.Errorf("plan %v, kept %v", reshard.plan, reshard.kept)
+	}
+	if reshard.sameEndpoint("localhost:6379", "127.0.0.1:6380") {
+		t.Errorf("other port is the same endpoint")
+	}
+}
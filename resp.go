@@ -0,0 +1,88 @@
+package main
+
+// RESP protocol helpers for talking to redis without redigo (replication streams)
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrProtocol is returned when peer sends malformed RESP
+	ErrProtocol = errors.New("resp: protocol error")
+)
+
+// write command as RESP array of bulk strings, caller flushes
+func writeCommand(w *bufio.Writer, args ...string) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(arg)))
+		w.WriteString("\r\n")
+		w.WriteString(arg)
+		_, err := w.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read line without CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// read command sent as RESP array of bulk strings, size is number of bytes consumed
+func readCommand(r *bufio.Reader) (args []string, size int64, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	size += int64(len(line))
+
+	if !strings.HasPrefix(line, "*") {
+		return nil, 0, ErrProtocol
+	}
+	n, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil || n < 0 {
+		return nil, 0, ErrProtocol
+	}
+
+	args = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(line))
+
+		if !strings.HasPrefix(line, "$") {
+			return nil, 0, ErrProtocol
+		}
+		length, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+		if err != nil || length < 0 {
+			return nil, 0, ErrProtocol
+		}
+
+		// bulk is followed by CRLF
+		bulk := make([]byte, length+2)
+		_, err = io.ReadFull(r, bulk)
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(bulk))
+
+		args = append(args, string(bulk[:length]))
+	}
+	return args, size, nil
+}
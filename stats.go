@@ -0,0 +1,135 @@
+package main
+
+// Reply accounting: every written command is counted as success or failure of its error class
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrCrossShard is counted for multi-key command whose keys have different owners, it isn't sent
+var ErrCrossShard = redis.Error("CROSSSHARD keys of command belong to different nodes, not sent")
+
+// SendStats counts replies of written commands, failures are grouped by error class (BUSYKEY, OOM, ERR...)
+type SendStats struct {
+	lock   sync.Mutex
+	ok     int64
+	errors map[string]int64
+
+	// called with every reply
+	replied []func(cmd *RedisCommand, replyErr error)
+}
+
+// NewSendStats returns empty stats
+func NewSendStats() *SendStats {
+	return &SendStats{errors: map[string]int64{}}
+}
+
+// class of error reply is its first word
+func errorClass(replyErr redis.Error) string {
+	fields := strings.Fields(string(replyErr))
+	if len(fields) == 0 {
+		return "ERR"
+	}
+	return fields[0]
+}
+
+// record reply of cmd, first failure of every class is reported with its key
+func (s *SendStats) record(cmd *RedisCommand, replyErr error) {
+	// command is no longer in flight
+	sendBudget.Release(cmd.BulkSize)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, replied := range s.replied {
+		replied(cmd, replyErr)
+	}
+
+	if replyErr == nil {
+		s.ok++
+		return
+	}
+
+	class := "ERR"
+	if e, ok := replyErr.(redis.Error); ok {
+		class = errorClass(e)
+	}
+	if s.errors[class] == 0 {
+		fmt.Fprintf(os.Stderr, "send: %s %q failed: %s\n", cmd.Command[0], cmd.Key, replyErr)
+	}
+	s.errors[class]++
+}
+
+// onReply adds function called with every reply, before it is counted
+func (s *SendStats) onReply(replied func(cmd *RedisCommand, replyErr error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.replied = append(s.replied, replied)
+}
+
+// merge adds counts of other stats
+func (s *SendStats) merge(other *SendStats) {
+	other.lock.Lock()
+	defer other.lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ok += other.ok
+	for class, n := range other.errors {
+		s.errors[class] += n
+	}
+}
+
+// OK returns number of successful commands
+func (s *SendStats) OK() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ok
+}
+
+// Failed returns number of failed commands
+func (s *SendStats) Failed() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var failed int64
+	for _, n := range s.errors {
+		failed += n
+	}
+	return failed
+}
+
+// Errors returns number of failures by error class
+func (s *SendStats) Errors() map[string]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errors := make(map[string]int64, len(s.errors))
+	for class, n := range s.errors {
+		errors[class] = n
+	}
+	return errors
+}
+
+// Print writes summary, error classes are sorted by name
+func (s *SendStats) Print(w io.Writer) {
+	ok, failed, errors := s.OK(), s.Failed(), s.Errors()
+
+	fmt.Fprintf(w, "sent %d commands: %d ok, %d failed\n", ok+failed, ok, failed)
+
+	classes := make([]string, 0, len(errors))
+	for class := range errors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "  %s: %d\n", class, errors[class])
+	}
+}
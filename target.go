@@ -0,0 +1,345 @@
+package main
+
+// Targets receive commands produced by parser and write them to redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Target writes commands to single redis, twemproxy or redis cluster
+type Target interface {
+	// Send queues command, it may be written later
+	Send(cmd *RedisCommand) error
+	// SendAll queues command without key (FUNCTION RESTORE, SCRIPT LOAD) on every node
+	SendAll(cmd *RedisCommand) error
+	// Flush writes queued commands
+	Flush() error
+	// Close writes queued commands, reads all replies and closes connections
+	Close() error
+	// Stats counts replies of written commands
+	Stats() *SendStats
+}
+
+func getTarget() (Target, error) {
+	target, err := newTarget()
+	if err != nil {
+		return nil, err
+	}
+	target, err = reshardTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return dbTarget(target)
+}
+
+func newTarget() (Target, error) {
+	addr := fmt.Sprintf("%s:%d", proxyHost, proxyPort)
+
+	if Cluster {
+		return NewClusterTarget(addr, proxyPassword, Pipeline)
+	}
+
+	if NutcrackerConf != "" {
+		pool, err := LoadTwemproxyPool(NutcrackerConf, NutcrackerPool)
+		if err != nil {
+			return nil, err
+		}
+		return NewTwemproxyTarget(pool, proxyPassword, Pipeline), nil
+	}
+
+	addrs := proxyAddrs(addr)
+	if Connections > 1 || len(addrs) > 1 || LargeKeySize > 0 {
+		return NewParallelTarget(addrs, proxyPassword, Connections, LargeConnections, LargeKeySize, Pipeline)
+	}
+
+	conn, err := getConn(addr, proxyPassword)
+	if err != nil {
+		return nil, err
+	}
+	return newSingleTarget(conn, Pipeline, NewSendStats(), nil), nil
+}
+
+// singleTarget sends every command to the same connection, replies are read concurrently
+type singleTarget struct {
+	conn  redis.Conn
+	stats *SendStats
+	// called after reply of command is read, may be nil
+	replied func(cmd *RedisCommand)
+	// db selected on connection, command of another db is preceded by SELECT
+	db int
+
+	// commands waiting for reply, capacity is max commands in flight
+	inflight chan *RedisCommand
+	pending  sync.WaitGroup
+	done     chan struct{}
+	// connection error met by reader
+	err     error
+	errLock sync.Mutex
+}
+
+func newSingleTarget(conn redis.Conn, pipeline int, stats *SendStats, replied func(cmd *RedisCommand)) *singleTarget {
+	if pipeline < 1 {
+		pipeline = 1
+	}
+
+	t := &singleTarget{
+		conn:     conn,
+		stats:    stats,
+		replied:  replied,
+		inflight: make(chan *RedisCommand, pipeline),
+		done:     make(chan struct{}),
+	}
+	go t.receive()
+	return t
+}
+
+// read reply of every command in order they were sent
+func (t *singleTarget) receive() {
+	defer close(t.done)
+
+	for cmd := range t.inflight {
+		_, err := t.conn.Receive()
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			t.pending.Done()
+			t.fail(err)
+			return
+		}
+
+		// SELECT isn't counted, but following commands would go to wrong db without it
+		if isSelect(cmd) {
+			t.pending.Done()
+			if err != nil {
+				t.fail(fmt.Errorf("target: SELECT %s failed: %s", cmd.Command[1], err))
+				return
+			}
+			continue
+		}
+
+		t.stats.record(cmd, err)
+		if t.replied != nil {
+			t.replied(cmd)
+		}
+		t.pending.Done()
+	}
+}
+
+// stop reading replies after err
+func (t *singleTarget) fail(err error) {
+	t.errLock.Lock()
+	t.err = err
+	t.errLock.Unlock()
+
+	// nothing more can be read, unblock sender
+	for range t.inflight {
+		t.pending.Done()
+	}
+}
+
+// SELECT sent by target itself, commands of keys always have key
+func isSelect(cmd *RedisCommand) bool {
+	return cmd.Key == "" && len(cmd.Command) == 2 && cmd.Command[0] == "SELECT"
+}
+
+func (t *singleTarget) readErr() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.err
+}
+
+func (t *singleTarget) Send(cmd *RedisCommand) error {
+	err := t.readErr()
+	if err != nil {
+		return err
+	}
+
+	if cmd.DB != t.db {
+		err = t.send(&RedisCommand{Command: []string{"SELECT", strconv.Itoa(cmd.DB)}, DB: cmd.DB})
+		if err != nil {
+			return err
+		}
+		t.db = cmd.DB
+	}
+	return t.send(cmd)
+}
+
+// write command and wait while window is full
+func (t *singleTarget) send(cmd *RedisCommand) error {
+	err := t.conn.Send(cmd.Command[0], cmd.args()...)
+	if err != nil {
+		return err
+	}
+
+	t.pending.Add(1)
+	select {
+	case t.inflight <- cmd:
+		return nil
+	default:
+	}
+
+	// window is full, replies come only for written commands
+	err = t.conn.Flush()
+	if err != nil {
+		return err
+	}
+	t.inflight <- cmd
+	return nil
+}
+
+// SendAll sends cmd, there is single node
+func (t *singleTarget) SendAll(cmd *RedisCommand) error {
+	return t.Send(cmd)
+}
+
+func (t *singleTarget) Flush() error {
+	err := t.readErr()
+	if err != nil {
+		return err
+	}
+	return t.conn.Flush()
+}
+
+// wait flushes commands and waits for their replies
+func (t *singleTarget) wait() error {
+	err := t.Flush()
+	if err != nil {
+		return err
+	}
+	t.pending.Wait()
+	return t.readErr()
+}
+
+func (t *singleTarget) Close() error {
+	err := t.conn.Flush()
+	close(t.inflight)
+	<-t.done
+
+	if err == nil {
+		err = t.readErr()
+	}
+	closeErr := t.conn.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (t *singleTarget) Stats() *SendStats {
+	return t.stats
+}
+
+// arguments of command for redis.Conn.Send
+func (cmd *RedisCommand) args() []interface{} {
+	args := make([]interface{}, len(cmd.Command[1:]))
+
+	for i, arg := range cmd.Command[1:] {
+		args[i] = arg
+	}
+	return args
+}
+
+// queued command with redirect state
+type queuedCommand struct {
+	cmd       *RedisCommand
+	asking    bool
+	redirects int
+}
+
+// connection to single redis node with commands waiting to be pipelined
+type pipelineNode struct {
+	addr    string
+	conn    redis.Conn
+	pending []*queuedCommand
+}
+
+// write pending commands in one pipeline and read all replies, error replies are passed to onError
+func (node *pipelineNode) flush(stats *SendStats, onError func(c *queuedCommand, replyErr redis.Error) error) error {
+	pending := node.pending
+	node.pending = nil
+
+	for _, c := range pending {
+		if c.asking {
+			err := node.conn.Send("ASKING")
+			if err != nil {
+				return err
+			}
+		}
+		err := node.conn.Send(c.cmd.Command[0], c.cmd.args()...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := node.conn.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range pending {
+		if c.asking {
+			_, err = node.conn.Receive()
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = node.conn.Receive()
+		if err == nil {
+			stats.record(c.cmd, nil)
+			continue
+		}
+
+		replyErr, ok := err.(redis.Error)
+		if !ok {
+			return err
+		}
+
+		err = onError(c, replyErr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush nodes until nothing is pending, onError may queue commands again
+func flushNodes(nodes map[string]*pipelineNode, stats *SendStats, onError func(c *queuedCommand, replyErr redis.Error) error) error {
+	for {
+		var node *pipelineNode
+		for _, n := range nodes {
+			if len(n.pending) > 0 {
+				node = n
+				break
+			}
+		}
+		if node == nil {
+			break
+		}
+
+		err := node.flush(stats, onError)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush nodes and close connections
+func closeNodes(nodes map[string]*pipelineNode, stats *SendStats, onError func(c *queuedCommand, replyErr redis.Error) error) error {
+	err := flushNodes(nodes, stats, onError)
+	if err != nil {
+		return err
+	}
+
+	var result error
+	for _, node := range nodes {
+		err := node.conn.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
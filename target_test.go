@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redis answering SET and SELECT with OK, RESTORE with BUSYKEY and everything else with ERR, received is called for every command when not nil
+func fakeRedis(t *testing.T, received func(args []string)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+				for {
+					args, _, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					if received != nil {
+						received(args)
+					}
+					switch args[0] {
+					case "SET", "SELECT", "FLUSHDB":
+						writer.WriteString("+OK\r\n")
+					case "RESTORE":
+						writer.WriteString("-BUSYKEY Target key name already exists.\r\n")
+					default:
+						fmt.Fprintf(writer, "-ERR unknown command '%s'\r\n", args[0])
+					}
+					// replies are flushed when nothing else is buffered, as redis does
+					if reader.Buffered() == 0 {
+						writer.Flush()
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestSingleTarget(t *testing.T) {
+	conn, err := redis.Dial("tcp", fakeRedis(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := newSingleTarget(conn, 4, NewSendStats(), nil)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		name := "SET"
+		if i%10 == 0 {
+			name = "RESTORE"
+		} else if i%25 == 1 {
+			name = "BAD"
+		}
+		if err := target.Send(&RedisCommand{Command: []string{name, key, "value"}, Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := target.Stats()
+	if stats.OK() != 86 || stats.Failed() != 14 {
+		t.Errorf("%d ok and %d failed, expected 86 and 14", stats.OK(), stats.Failed())
+	}
+	if errors := stats.Errors(); !reflect.DeepEqual(errors, map[string]int64{"BUSYKEY": 10, "ERR": 4}) {
+		t.Errorf("errors by class %v", errors)
+	}
+}
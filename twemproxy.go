@@ -0,0 +1,624 @@
+package main
+
+// Twemproxy (nutcracker) compatible sharding: keys are written straight to the backend server twemproxy would pick
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// defaults of nutcracker pool
+	twemproxyDefaultHash         = "fnv1a_64"
+	twemproxyDefaultDistribution = "ketama"
+
+	// libmemcached compatibility, port 11211 is not part of server name
+	twemproxyKetamaPort = 11211
+
+	// points of one server on ketama continuum, 4 points per md5
+	ketamaPointsPerServer = 160
+)
+
+var (
+	// ErrEmptyPool is returned for pool without servers
+	ErrEmptyPool = errors.New("twemproxy: pool has no servers")
+)
+
+// twemproxy hash functions, all return 32 bit hash as nc_hashkit
+var twemproxyHashes = map[string]func(key []byte) uint32{
+	"one_at_a_time": hashOneAtATime,
+	"md5":           hashMD5,
+	"crc16":         hashCRC16,
+	"crc32":         hashCRC32,
+	"crc32a":        hashCRC32a,
+	"fnv1_64":       hashFNV1_64,
+	"fnv1a_64":      hashFNV1a_64,
+	"fnv1_32":       hashFNV1_32,
+	"fnv1a_32":      hashFNV1a_32,
+	"hsieh":         hashHsieh,
+	"murmur":        hashMurmur,
+	"jenkins":       hashJenkins,
+}
+
+// twemproxy reads key bytes as signed char, bytes >= 0x80 are sign extended
+func signExtend(c byte) uint32 {
+	return uint32(int32(int8(c)))
+}
+
+func hashOneAtATime(key []byte) uint32 {
+	var value uint32
+	for _, c := range key {
+		value += signExtend(c)
+		value += value << 10
+		value ^= value >> 6
+	}
+	value += value << 3
+	value ^= value >> 11
+	value += value << 15
+	return value
+}
+
+func hashMD5(key []byte) uint32 {
+	sum := md5.Sum(key)
+	return uint32(sum[3])<<24 | uint32(sum[2])<<16 | uint32(sum[1])<<8 | uint32(sum[0])
+}
+
+// crc16 of twemproxy isn't truncated to 16 bits
+func hashCRC16(key []byte) uint32 {
+	var crc uint32
+	for _, c := range key {
+		crc = crc<<8 ^ uint32(crc16Table[byte(crc>>8)^c])
+	}
+	return crc
+}
+
+func hashCRC32(key []byte) uint32 {
+	return crc32.ChecksumIEEE(key) >> 16 & 0x7fff
+}
+
+func hashCRC32a(key []byte) uint32 {
+	return crc32.ChecksumIEEE(key)
+}
+
+func hashFNV1_64(key []byte) uint32 {
+	hash := uint64(0xcbf29ce484222325)
+	for _, c := range key {
+		hash *= 0x100000001b3
+		hash ^= uint64(int64(int8(c)))
+	}
+	return uint32(hash)
+}
+
+// fnv1a_64 of twemproxy is calculated in 32 bits with truncated 64 bit constants
+func hashFNV1a_64(key []byte) uint32 {
+	hash := uint32(0x84222325)
+	for _, c := range key {
+		hash ^= signExtend(c)
+		hash *= 0x1b3
+	}
+	return hash
+}
+
+func hashFNV1_32(key []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, c := range key {
+		hash *= 16777619
+		hash ^= signExtend(c)
+	}
+	return hash
+}
+
+func hashFNV1a_32(key []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, c := range key {
+		hash ^= signExtend(c)
+		hash *= 16777619
+	}
+	return hash
+}
+
+// Paul Hsieh's SuperFastHash with zero initial value
+func hashHsieh(key []byte) uint32 {
+	if len(key) == 0 {
+		return 0
+	}
+
+	get16 := func(p []byte) uint32 {
+		return uint32(p[1])<<8 + uint32(p[0])
+	}
+
+	var hash uint32
+	rem := len(key) & 3
+	for n := len(key) >> 2; n > 0; n-- {
+		hash += get16(key)
+		tmp := get16(key[2:])<<11 ^ hash
+		hash = hash<<16 ^ tmp
+		key = key[4:]
+		hash += hash >> 11
+	}
+
+	switch rem {
+	case 3:
+		hash += get16(key)
+		hash ^= hash << 16
+		hash ^= signExtend(key[2]) << 18
+		hash += hash >> 11
+	case 2:
+		hash += get16(key)
+		hash ^= hash << 11
+		hash += hash >> 17
+	case 1:
+		hash += uint32(key[0])
+		hash ^= hash << 10
+		hash += hash >> 1
+	}
+
+	hash ^= hash << 3
+	hash += hash >> 5
+	hash ^= hash << 4
+	hash += hash >> 17
+	hash ^= hash << 25
+	hash += hash >> 6
+	return hash
+}
+
+// MurmurHash2 seeded with key length
+func hashMurmur(key []byte) uint32 {
+	const m = 0x5bd1e995
+	length := uint32(len(key))
+	h := 0xdeadbeef*length ^ length
+
+	for len(key) >= 4 {
+		k := uint32(key[0]) | uint32(key[1])<<8 | uint32(key[2])<<16 | uint32(key[3])<<24
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+		key = key[4:]
+	}
+
+	switch len(key) {
+	case 3:
+		h ^= uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(key[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+func hashJenkins(key []byte) uint32 {
+	return hashLittle(key, 13)
+}
+
+// Bob Jenkins' lookup3 hashlittle
+func hashLittle(key []byte, initval uint32) uint32 {
+	a := 0xdeadbeef + uint32(len(key)) + initval
+	b, c := a, a
+
+	word := func(p []byte) uint32 {
+		var v uint32
+		for i := len(p) - 1; i >= 0; i-- {
+			v = v<<8 | uint32(p[i])
+		}
+		return v
+	}
+
+	for len(key) > 12 {
+		a += word(key[0:4])
+		b += word(key[4:8])
+		c += word(key[8:12])
+
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+
+		key = key[12:]
+	}
+
+	if len(key) == 0 {
+		return c
+	}
+	switch {
+	case len(key) > 8:
+		c += word(key[8:])
+		b += word(key[4:8])
+		a += word(key[0:4])
+	case len(key) > 4:
+		b += word(key[4:])
+		a += word(key[0:4])
+	default:
+		a += word(key)
+	}
+
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+	return c
+}
+
+// TwemproxyServer is backend of pool, "host:port:weight [name]" in nutcracker.yml
+type TwemproxyServer struct {
+	Addr   string
+	Name   string
+	Weight int
+}
+
+// point of continuum, owned by server with index
+type continuumPoint struct {
+	value uint32
+	index int
+}
+
+// TwemproxyPool picks backend server of key exactly as twemproxy pool does
+type TwemproxyPool struct {
+	Name         string
+	Hash         string
+	HashTag      string
+	Distribution string
+	Password     string
+	DB           int
+	Servers      []*TwemproxyServer
+
+	hash      func(key []byte) uint32
+	continuum []continuumPoint
+}
+
+// pool section of nutcracker.yml
+type twemproxyPoolConf struct {
+	Hash         string   `yaml:"hash"`
+	HashTag      string   `yaml:"hash_tag"`
+	Distribution string   `yaml:"distribution"`
+	RedisAuth    string   `yaml:"redis_auth"`
+	RedisDB      int      `yaml:"redis_db"`
+	Servers      []string `yaml:"servers"`
+}
+
+// LoadTwemproxyPool reads pool from nutcracker.yml, name may be empty when file has single pool
+func LoadTwemproxyPool(path string, name string) (*TwemproxyPool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pools map[string]*twemproxyPoolConf
+	err = yaml.Unmarshal(contents, &pools)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		if len(pools) != 1 {
+			return nil, fmt.Errorf("twemproxy: %s has %d pools, choose one", path, len(pools))
+		}
+		for poolName := range pools {
+			name = poolName
+		}
+	}
+
+	conf, ok := pools[name]
+	if !ok || conf == nil {
+		return nil, fmt.Errorf("twemproxy: pool %q not found in %s", name, path)
+	}
+
+	servers := make([]*TwemproxyServer, 0, len(conf.Servers))
+	for _, line := range conf.Servers {
+		server, err := parseTwemproxyServer(line)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	pool, err := NewTwemproxyPool(conf.Hash, conf.HashTag, conf.Distribution, servers)
+	if err != nil {
+		return nil, err
+	}
+	pool.Name = name
+	pool.Password = conf.RedisAuth
+	pool.DB = conf.RedisDB
+	return pool, nil
+}
+
+// "host:port:weight [name]", name defaults to host:port (host for memcached port)
+func parseTwemproxyServer(line string) (*TwemproxyServer, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("twemproxy: bad server %q", line)
+	}
+
+	parts := strings.Split(fields[0], ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("twemproxy: bad server %q, expected host:port:weight", line)
+	}
+
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("twemproxy: bad server port %q", line)
+	}
+	weight, err := strconv.Atoi(parts[2])
+	if err != nil || weight < 1 {
+		return nil, fmt.Errorf("twemproxy: bad server weight %q", line)
+	}
+
+	server := &TwemproxyServer{
+		Addr:   parts[0] + ":" + parts[1],
+		Weight: weight,
+	}
+
+	switch {
+	case len(fields) == 2:
+		server.Name = fields[1]
+	case port == twemproxyKetamaPort:
+		server.Name = parts[0]
+	default:
+		server.Name = server.Addr
+	}
+	return server, nil
+}
+
+// NewTwemproxyPool builds continuum of servers, empty hash and distribution mean twemproxy defaults
+func NewTwemproxyPool(hash string, hashTag string, distribution string, servers []*TwemproxyServer) (*TwemproxyPool, error) {
+	if hash == "" {
+		hash = twemproxyDefaultHash
+	}
+	if distribution == "" {
+		distribution = twemproxyDefaultDistribution
+	}
+	if hashTag != "" && len(hashTag) != 2 {
+		return nil, fmt.Errorf("twemproxy: hash_tag %q must be 2 characters", hashTag)
+	}
+	if len(servers) == 0 {
+		return nil, ErrEmptyPool
+	}
+
+	pool := &TwemproxyPool{
+		Hash:         hash,
+		HashTag:      hashTag,
+		Distribution: distribution,
+		Servers:      servers,
+		hash:         twemproxyHashes[hash],
+	}
+	if pool.hash == nil {
+		return nil, fmt.Errorf("twemproxy: unknown hash %q", hash)
+	}
+
+	switch distribution {
+	case "ketama":
+		pool.continuum = ketamaContinuum(servers)
+	case "modula", "random":
+		// every server appears weight times
+		for i, server := range servers {
+			for j := 0; j < server.Weight; j++ {
+				pool.continuum = append(pool.continuum, continuumPoint{index: i})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("twemproxy: unknown distribution %q", distribution)
+	}
+
+	return pool, nil
+}
+
+// points of every server are md5 of "name-n", same float32 arithmetic as nc_ketama
+func ketamaContinuum(servers []*TwemproxyServer) []continuumPoint {
+	totalWeight := 0
+	for _, server := range servers {
+		totalWeight += server.Weight
+	}
+
+	var continuum []continuumPoint
+	for i, server := range servers {
+		pct := float32(server.Weight) / float32(totalWeight)
+		points := float32(pct*ketamaPointsPerServer/4) * float32(len(servers))
+		perServer := uint32(float32(math.Floor(float64(float32(float64(points)+0.0000000001)))) * 4)
+
+		for pointer := uint32(1); pointer <= perServer/4; pointer++ {
+			sum := md5.Sum([]byte(fmt.Sprintf("%s-%d", server.Name, pointer-1)))
+			for x := 0; x < 4; x++ {
+				value := uint32(sum[3+x*4])<<24 | uint32(sum[2+x*4])<<16 | uint32(sum[1+x*4])<<8 | uint32(sum[x*4])
+				continuum = append(continuum, continuumPoint{value: value, index: i})
+			}
+		}
+	}
+
+	sort.SliceStable(continuum, func(i, j int) bool {
+		return continuum[i].value < continuum[j].value
+	})
+	return continuum
+}
+
+// part of key hashed by pool, text between hash_tag characters when present
+func (pool *TwemproxyPool) hashKey(key string) string {
+	if pool.HashTag == "" {
+		return key
+	}
+	if start := strings.IndexByte(key, pool.HashTag[0]); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], pool.HashTag[1]); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// Server returns backend server of key
+func (pool *TwemproxyPool) Server(key string) *TwemproxyServer {
+	var index int
+
+	switch pool.Distribution {
+	case "ketama":
+		hash := pool.hash([]byte(pool.hashKey(key)))
+		i := sort.Search(len(pool.continuum), func(i int) bool {
+			return pool.continuum[i].value >= hash
+		})
+		if i == len(pool.continuum) {
+			i = 0
+		}
+		index = pool.continuum[i].index
+	case "modula":
+		hash := pool.hash([]byte(pool.hashKey(key)))
+		index = pool.continuum[hash%uint32(len(pool.continuum))].index
+	default:
+		index = pool.continuum[rand.Intn(len(pool.continuum))].index
+	}
+
+	return pool.Servers[index]
+}
+
+// TwemproxyTarget writes every key to backend server of twemproxy pool, pipelining per server
+type TwemproxyTarget struct {
+	pool     *TwemproxyPool
+	password string
+	pipeline int
+	stats    *SendStats
+
+	nodes map[string]*pipelineNode
+}
+
+// NewTwemproxyTarget connects to backends of pool lazily, redis_auth of pool overrides password
+func NewTwemproxyTarget(pool *TwemproxyPool, password string, pipeline int) *TwemproxyTarget {
+	if pipeline < 1 {
+		pipeline = 1
+	}
+	if pool.Password != "" {
+		password = pool.Password
+	}
+
+	return &TwemproxyTarget{
+		pool:     pool,
+		password: password,
+		pipeline: pipeline,
+		stats:    NewSendStats(),
+		nodes:    map[string]*pipelineNode{},
+	}
+}
+
+// connection to backend, dialed on first use
+func (t *TwemproxyTarget) node(addr string) (*pipelineNode, error) {
+	node, ok := t.nodes[addr]
+	if ok {
+		return node, nil
+	}
+
+	conn, err := getConn(addr, t.password)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.pool.DB != 0 {
+		_, err = conn.Do("SELECT", t.pool.DB)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	node = &pipelineNode{addr: addr, conn: conn}
+	t.nodes[addr] = node
+	return node, nil
+}
+
+// Send routes command to backend server of its key, keys of multi-key command must share server
+func (t *TwemproxyTarget) Send(cmd *RedisCommand) error {
+	if !cmd.sameOwner(t.pool.Owner) {
+		t.stats.record(cmd, ErrCrossShard)
+		return nil
+	}
+
+	node, err := t.node(t.pool.Server(cmd.Key).Addr)
+	if err != nil {
+		return err
+	}
+
+	node.pending = append(node.pending, &queuedCommand{cmd: cmd})
+	if len(node.pending) >= t.pipeline {
+		return node.flush(t.stats, t.report)
+	}
+	return nil
+}
+
+// SendAll queues command on every backend server
+func (t *TwemproxyTarget) SendAll(cmd *RedisCommand) error {
+	for _, server := range t.pool.Servers {
+		node, err := t.node(server.Addr)
+		if err != nil {
+			return err
+		}
+		node.pending = append(node.pending, &queuedCommand{cmd: cmd})
+		if len(node.pending) >= t.pipeline {
+			err = node.flush(t.stats, t.report)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errors are counted and command is dropped
+func (t *TwemproxyTarget) report(c *queuedCommand, replyErr redis.Error) error {
+	t.stats.record(c.cmd, replyErr)
+	return nil
+}
+
+// Flush writes all pending commands
+func (t *TwemproxyTarget) Flush() error {
+	return flushNodes(t.nodes, t.stats, t.report)
+}
+
+// Close writes all pending commands and closes connections
+func (t *TwemproxyTarget) Close() error {
+	return closeNodes(t.nodes, t.stats, t.report)
+}
+
+// Stats counts replies of all backends
+func (t *TwemproxyTarget) Stats() *SendStats {
+	return t.stats
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var hashKeys = []string{"", "a", "foo", "foobar", "key:000000000001", "{user1000}.following", "\xff\xfe binary \x80"}
+
+func TestTwemproxyHashes(t *testing.T) {
+	for _, key := range hashKeys {
+		data := []byte(key)
+
+		sum := md5.Sum(data)
+		if got, want := hashMD5(data), binary.LittleEndian.Uint32(sum[:4]); got != want {
+			t.Errorf("md5(%q) = %x, expected %x", key, got, want)
+		}
+		if got, want := hashCRC32a(data), crc32.ChecksumIEEE(data); got != want {
+			t.Errorf("crc32a(%q) = %x, expected %x", key, got, want)
+		}
+		if got, want := hashCRC32(data), crc32.ChecksumIEEE(data)>>16&0x7fff; got != want {
+			t.Errorf("crc32(%q) = %x, expected %x", key, got, want)
+		}
+
+		// reference implementations differ from twemproxy for bytes >= 0x80 only
+		ascii := true
+		for _, c := range data {
+			ascii = ascii && c < 0x80
+		}
+		if !ascii {
+			continue
+		}
+
+		h32 := fnv.New32()
+		h32.Write(data)
+		if got, want := hashFNV1_32(data), h32.Sum32(); got != want {
+			t.Errorf("fnv1_32(%q) = %x, expected %x", key, got, want)
+		}
+		h32a := fnv.New32a()
+		h32a.Write(data)
+		if got, want := hashFNV1a_32(data), h32a.Sum32(); got != want {
+			t.Errorf("fnv1a_32(%q) = %x, expected %x", key, got, want)
+		}
+		h64 := fnv.New64()
+		h64.Write(data)
+		if got, want := hashFNV1_64(data), uint32(h64.Sum64()); got != want {
+			t.Errorf("fnv1_64(%q) = %x, expected %x", key, got, want)
+		}
+		if got, want := hashCRC16(data)&0xffff, uint32(CRC16(data)); got != want {
+			t.Errorf("crc16(%q) = %x, expected %x", key, got, want)
+		}
+	}
+}
+
+func TestHashLittle(t *testing.T) {
+	// test vectors of lookup3.c
+	cases := []struct {
+		key     string
+		initval uint32
+		hash    uint32
+	}{
+		{"", 0, 0xdeadbeef},
+		{"", 0xdeadbeef, 0xbd5b7dde},
+		{"Four score and seven years ago", 0, 0x17770551},
+		{"Four score and seven years ago", 1, 0xcd628161},
+	}
+	for _, c := range cases {
+		if got := hashLittle([]byte(c.key), c.initval); got != c.hash {
+			t.Errorf("hashlittle(%q, %d) = %x, expected %x", c.key, c.initval, got, c.hash)
+		}
+	}
+}
+
+func TestTwemproxyPool(t *testing.T) {
+	conf := `alpha:
+  listen: 127.0.0.1:22121
+  hash: fnv1a_64
+  hash_tag: "{}"
+  distribution: ketama
+  redis: true
+  redis_auth: secret
+  servers:
+   - 127.0.0.1:6379:1 server1
+   - 127.0.0.1:6380:1
+   - 127.0.0.1:11211:2
+beta:
+  hash: murmur
+  distribution: modula
+  servers:
+   - 127.0.0.1:7000:1
+   - 127.0.0.1:7001:3
+`
+	path := filepath.Join(t.TempDir(), "nutcracker.yml")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadTwemproxyPool(path, ""); err == nil {
+		t.Errorf("pool must be chosen when file has several pools")
+	}
+
+	alpha, err := LoadTwemproxyPool(path, "alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha.Password != "secret" {
+		t.Errorf("redis_auth is %q", alpha.Password)
+	}
+	names := []string{alpha.Servers[0].Name, alpha.Servers[1].Name, alpha.Servers[2].Name}
+	if names[0] != "server1" || names[1] != "127.0.0.1:6380" || names[2] != "127.0.0.1" {
+		t.Errorf("server names are %v", names)
+	}
+
+	// 160 points for every unit of weight
+	points := map[int]int{}
+	for _, point := range alpha.continuum {
+		points[point.index]++
+	}
+	if points[0] != 120 || points[1] != 120 || points[2] != 240 {
+		t.Errorf("ketama points are %v", points)
+	}
+
+	// only hash tag is hashed
+	if alpha.Server("{user1000}.following") != alpha.Server("{user1000}.followers") {
+		t.Errorf("keys with same hash tag are on different servers")
+	}
+	if alpha.Server("user1000") != alpha.Server("{user1000}.following") {
+		t.Errorf("hash tag isn't hashed as plain key")
+	}
+
+	beta, err := LoadTwemproxyPool(path, "beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range hashKeys {
+		index := 1
+		if hashMurmur([]byte(key))%4 == 0 {
+			index = 0
+		}
+		if got := beta.Server(key); got != beta.Servers[index] {
+			t.Errorf("modula placed %q on %s, expected %s", key, got.Addr, beta.Servers[index].Addr)
+		}
+	}
+}